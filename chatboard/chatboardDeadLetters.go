@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"os"
+)
+
+var showBody = flag.Bool("body", false, "print request bodies on deadletters list")
+
+// deadLetters runs list, replay or purge on quarantine of service
+func deadLetters(command, service string) {
+	switch command {
+	case "list", "replay", "purge":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := common.LoadConfig()
+	if err != nil {
+		logging.Default().Fatal("cannot load config", "error", err)
+	}
+
+	var reqQName string
+	switch service {
+	case "users":
+		reqQName = config.UsersReqQName
+	case "topics":
+		reqQName = config.TopicsReqQName
+	case "sessions":
+		reqQName = config.SessionsReqQName
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	quarantine := rabbitrpc.QuarantineQueueName(reqQName)
+
+	switch command {
+	case "list":
+		letters, err := rabbitrpc.ListDeadLetters(
+			config.RabbitURL,
+			quarantine,
+		)
+		if err != nil {
+			logging.Default().Fatal("cannot list", "queue", quarantine, "error", err)
+		}
+		for i, letter := range letters {
+			fmt.Printf(
+				"%d\t%s\tretried %d\tto %s/%s\t%s\n",
+				i,
+				letter.CorrelationId,
+				letter.RetryCount,
+				letter.OriginalExchange,
+				letter.OriginalRoutingKey,
+				letter.Error,
+			)
+			if *showBody {
+				fmt.Printf("\t[%s] %q\n", letter.ContentType, letter.Body)
+			}
+		}
+		fmt.Printf("%d messages in %s\n", len(letters), quarantine)
+
+	case "replay":
+		replayed, err := rabbitrpc.ReplayDeadLetters(
+			config.RabbitURL,
+			quarantine,
+		)
+		fmt.Printf("replayed %d messages from %s\n", replayed, quarantine)
+		if err != nil {
+			logging.Default().Fatal("cannot replay", "queue", quarantine, "error", err)
+		}
+
+	case "purge":
+		purged, err := rabbitrpc.PurgeDeadLetters(
+			config.RabbitURL,
+			quarantine,
+		)
+		if err != nil {
+			logging.Default().Fatal("cannot purge", "queue", quarantine, "error", err)
+		}
+		fmt.Printf("purged %d messages from %s\n", purged, quarantine)
+	}
+}
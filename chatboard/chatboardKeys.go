@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/keyring"
+	"learning-web-chatboard3/logging"
+	"os"
+)
+
+// rotateKeys adds a new verify-only key to the key ring,
+// promoteKey makes it primary once every router knows it
+func rotateKeys() {
+	changeKeyRing(func(ring *keyring.Ring) error {
+		key, err := ring.Add()
+		if err != nil {
+			return err
+		}
+		if key.Id == ring.Primary {
+			fmt.Fprintf(os.Stderr, "added primary key %s\n", key.Id)
+			return nil
+		}
+		fmt.Fprintf(
+			os.Stderr,
+			"added key %s, restart every router then run promote-key %s\n",
+			key.Id,
+			key.Id,
+		)
+		return nil
+	})
+}
+
+// promoteKey makes key of id primary
+func promoteKey(id string) {
+	changeKeyRing(func(ring *keyring.Ring) error {
+		err := ring.Promote(id)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "promoted key %s\n", id)
+		}
+		return err
+	})
+}
+
+// retireKey removes key of id from the key ring
+func retireKey(id string) {
+	changeKeyRing(func(ring *keyring.Ring) error {
+		err := ring.Retire(id)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "retired key %s\n", id)
+		}
+		return err
+	})
+}
+
+// changeKeyRing saves the changed key_ring_file,
+// which is created if missing.
+// the changed key_ring is printed instead,
+// to be set to CHATBOARD_KEY_RING.
+func changeKeyRing(change func(ring *keyring.Ring) error) {
+	config, err := common.LoadConfig()
+	if err != nil {
+		logging.Default().Fatal("cannot load config", "error", err)
+	}
+
+	ring, err := keyring.Open(config)
+	switch {
+	case errors.Is(err, keyring.ErrNotConfigured):
+		logging.Default().Fatal("key_ring_file or key_ring is required")
+	case errors.Is(err, os.ErrNotExist):
+		ring = &keyring.Ring{}
+	case err != nil:
+		logging.Default().Fatal("cannot open key ring", "error", err)
+	}
+
+	err = change(ring)
+	if err != nil {
+		logging.Default().Fatal("cannot change key ring", "error", err)
+	}
+
+	if common.IsEmpty(config.KeyRingFile) {
+		bin, err := ring.Marshal()
+		if err != nil {
+			logging.Default().Fatal("cannot encode key ring", "error", err)
+		}
+		os.Stdout.Write(bin)
+		return
+	}
+	err = ring.Save(config.KeyRingFile)
+	if err != nil {
+		logging.Default().Fatal("cannot save key ring", "error", err)
+	}
+	for _, key := range ring.Keys {
+		mark := "verify"
+		if key.Id == ring.Primary {
+			mark = "primary"
+		}
+		fmt.Printf(
+			"%s\t%s\t%s\n",
+			mark,
+			key.Id,
+			key.CreatedAt.Format("2006-01-02 15:04:05"),
+		)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"learning-web-chatboard3/repository"
+	"learning-web-chatboard3/router"
+	"learning-web-chatboard3/sessions"
+	"learning-web-chatboard3/topics"
+	"learning-web-chatboard3/users"
+	"os"
+)
+
+const usage = `usage: chatboard [-body] [-config file] command
+
+  router      run the router, services are called on RabbitMQ
+  users       run the users service on RabbitMQ
+  topics      run the topics service on RabbitMQ
+  sessions    run the sessions service on RabbitMQ
+  all-in-one  run the router and every service in this process,
+              without RabbitMQ
+  migrate up      apply every migration not applied yet
+  migrate down    revert the latest applied migration
+  migrate status  show applied and pending migrations
+  rotate-keys     add a new verify-only key to the key ring
+  promote-key id  make key of id primary, it makes every new cookie,
+                  older keys keep validating cookies
+  retire-key id   remove key of id, its cookies are no longer valid
+  deadletters list|replay|purge users|topics|sessions
+                  show, send again or delete requests quarantined
+                  by the service, -body shows their bodies on list
+
+services refuse to start unless the database schema is
+at the version they expect, run migrate up after updating.
+
+the key ring is key_ring_file, created by the first rotate-keys,
+or key_ring, which rotate-keys prints changed instead.
+restart every router after changing it. rotate in two steps,
+rotate-keys and restart, then promote-key and restart,
+so that no router sees a cookie of a key it does not know yet.
+
+run in a directory next to router, ../config.json is read by default.
+every configuration field can be set by environment variable,
+CHATBOARD_ and the upper cased field name, e.g. CHATBOARD_DB_HOST.
+`
+
+func main() {
+	common.ConfigFlag()
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.Arg(0) == "migrate" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		migrate(flag.Arg(1))
+		return
+	}
+	if flag.Arg(0) == "promote-key" || flag.Arg(0) == "retire-key" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if flag.Arg(0) == "promote-key" {
+			promoteKey(flag.Arg(1))
+		} else {
+			retireKey(flag.Arg(1))
+		}
+		return
+	}
+	if flag.Arg(0) == "deadletters" {
+		if flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		deadLetters(flag.Arg(1), flag.Arg(2))
+		return
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "router":
+		router.Main()
+	case "users":
+		users.Main()
+	case "topics":
+		topics.Main()
+	case "sessions":
+		sessions.Main()
+	case "all-in-one":
+		allInOne()
+	case "rotate-keys":
+		rotateKeys()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// allInOne wires the router and services with in process transport.
+// every service shares one database and one log file,
+// told apart by the service field.
+func allInOne() {
+	config, err := common.LoadConfig()
+	if err != nil {
+		logging.Default().Fatal("cannot load config", "error", err)
+	}
+
+	logger, err := common.OpenLogger(config, config.LogFileNameRouter)
+	if err != nil {
+		logging.Default().Fatal("cannot open log", "error", err)
+	}
+	rabbitrpc.SetLogger(logger)
+
+	repos, err := repository.Open(config)
+	if err != nil {
+		logger.Fatal("cannot open database", "error", err)
+	}
+	defer repos.Close()
+
+	// one registry for every part of this process
+	common.ServeMetrics(config.MetricsAddressRouter, logger)
+
+	broker := rabbitrpc.NewInProcBroker()
+	users.Start(config, logger, repos, broker)
+	topics.Start(config, logger, repos, broker)
+	sessions.Start(config, logger, repos, broker)
+
+	// returns after the router has been shut down
+	router.Run(config, logger, broker)
+
+	users.Shutdown()
+	topics.Shutdown()
+	sessions.Shutdown()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	"learning-web-chatboard3/migrations"
+	"os"
+)
+
+// migrate runs migrate up, down or status on the configured database
+func migrate(command string) {
+	switch command {
+	case "up", "down", "status":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := common.LoadConfig()
+	if err != nil {
+		logging.Default().Fatal("cannot load config", "error", err)
+	}
+	dbEngine, err := common.OpenDb(config, 1)
+	if err != nil {
+		logging.Default().Fatal("cannot open database", "error", err)
+	}
+	defer dbEngine.Close()
+	// statements of migrations are not worth showing
+	dbEngine.ShowSQL(false)
+
+	switch command {
+	case "up":
+		applied, err := migrations.Up(dbEngine)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			logging.Default().Fatal("migrate up failed", "error", err)
+		}
+		if len(applied) == 0 {
+			fmt.Printf("already at version %d\n", migrations.Expected())
+		}
+
+	case "down":
+		reverted, err := migrations.Down(dbEngine)
+		if err != nil {
+			logging.Default().Fatal("migrate down failed", "error", err)
+		}
+		if reverted == nil {
+			fmt.Println("no migration applied")
+			return
+		}
+		fmt.Printf("reverted %04d_%s\n", reverted.Version, reverted.Name)
+
+	case "status":
+		statuses, err := migrations.Status(dbEngine)
+		if err != nil {
+			logging.Default().Fatal("migrate status failed", "error", err)
+		}
+		for _, status := range statuses {
+			mark := "pending"
+			if status.Applied {
+				mark = "applied"
+			}
+			fmt.Printf("%s\t%04d_%s\n", mark, status.Version, status.Name)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	"learning-web-chatboard3/metrics"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"learning-web-chatboard3/repository"
+	"learning-web-chatboard3/router"
+	"learning-web-chatboard3/sessions"
+	"learning-web-chatboard3/topics"
+	"learning-web-chatboard3/users"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// end to end tests, the router and every service
+// in this process on the in process broker and memory repositories,
+// as all-in-one runs them
+
+var testServer *httptest.Server
+var testConfig *common.Configuration
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	os.Setenv(common.EnvPrefix+"DB_DRIVER", "memory")
+	config, err := common.LoadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// cookies are sent back over plain http
+	config.UseSecureCookie = false
+	testConfig = config
+
+	logger := logging.New(io.Discard, logging.FormatLogfmt, logging.LevelError)
+	rabbitrpc.SetLogger(logger)
+
+	repos := repository.NewMemory()
+	broker := rabbitrpc.NewInProcBroker()
+	users.Start(config, logger, repos, broker)
+	topics.Start(config, logger, repos, broker)
+	sessions.Start(config, logger, repos, broker)
+	testServer = httptest.NewServer(router.Start(config, logger, broker))
+
+	code := m.Run()
+
+	testServer.Close()
+	router.Shutdown()
+	users.Shutdown()
+	topics.Shutdown()
+	sessions.Shutdown()
+	os.Exit(code)
+}
+
+// browser keeps cookies and does not follow redirects,
+// so that every answer is checked
+type browser struct {
+	t      *testing.T
+	client *http.Client
+}
+
+func newBrowser(t *testing.T) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &browser{
+		t: t,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// get is body of page of path, which must be answered with 200
+func (b *browser) get(path string) string {
+	b.t.Helper()
+	res, err := b.client.Get(testServer.URL + path)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		b.t.Fatalf("GET %s: %d %s", path, res.StatusCode, body)
+	}
+	return string(body)
+}
+
+// post sends form to path, answering status and Location
+func (b *browser) post(path string, form url.Values) (int, string) {
+	b.t.Helper()
+	res, err := b.client.PostForm(testServer.URL+path, form)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("Location")
+}
+
+var csrfPattern = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// submit posts form of page of path to action, with the token of the page
+func (b *browser) submit(path, action string, form url.Values) (int, string) {
+	b.t.Helper()
+	found := csrfPattern.FindStringSubmatch(b.get(path))
+	if found == nil {
+		b.t.Fatalf("no csrf token in %s", path)
+	}
+	form.Set("csrf_token", html.UnescapeString(found[1]))
+	return b.post(action, form)
+}
+
+var topicLinkPattern = regexp.MustCompile(`href="/topic/read\?id=([^"]*)"`)
+
+func TestBrowserFlow(t *testing.T) {
+	b := newBrowser(t)
+	account := url.Values{
+		"name":     {"browser"},
+		"email":    {"browser@example.com"},
+		"password": {"secret"},
+	}
+
+	status, location := b.submit("/user/signup", "/user/signup-account", account)
+	if status != http.StatusMovedPermanently || location != "/user/login" {
+		t.Fatalf("signup: %d %q", status, location)
+	}
+	status, _ = b.submit("/user/login", "/user/authenticate", url.Values{
+		"email":    {"browser@example.com"},
+		"password": {"wrong"},
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with wrong password: %d", status)
+	}
+	status, location = b.submit("/user/login", "/user/authenticate", url.Values{
+		"email":    account["email"],
+		"password": account["password"],
+	})
+	if status != http.StatusMovedPermanently || location != "/" {
+		t.Fatalf("login: %d %q", status, location)
+	}
+
+	status, _ = b.submit("/topic/new", "/topic/create", url.Values{
+		"topic": {"topic of browser"},
+	})
+	if status != http.StatusMovedPermanently {
+		t.Fatalf("new topic: %d", status)
+	}
+	index := b.get("/")
+	if !strings.Contains(index, "topic of browser") {
+		t.Fatal("topic not listed")
+	}
+	link := topicLinkPattern.FindStringSubmatch(index)
+	if link == nil {
+		t.Fatal("no link to topic")
+	}
+	topicId := html.UnescapeString(link[1])
+
+	page := "/topic/read?id=" + url.QueryEscape(topicId)
+	status, location = b.submit(page, "/topic/post", url.Values{
+		"topic_id": {topicId},
+		"body":     {"reply of browser"},
+	})
+	if status != http.StatusMovedPermanently {
+		t.Fatalf("reply: %d", status)
+	}
+	if !strings.Contains(b.get(location), "reply of browser") {
+		t.Error("reply not shown")
+	}
+}
+
+func TestBrowserPostWithoutToken(t *testing.T) {
+	b := newBrowser(t)
+	b.get("/user/signup")
+	status, _ := b.post("/user/signup-account", url.Values{
+		"name":     {"forged"},
+		"email":    {"forged@example.com"},
+		"password": {"secret"},
+	})
+	if status != http.StatusForbidden {
+		t.Errorf("post without csrf token: %d", status)
+	}
+}
+
+// api sends req as json with token, decoding the answer into res
+func api(t *testing.T, method, path, token string, req, res interface{}) int {
+	t.Helper()
+	var body io.Reader
+	if req != nil {
+		bin, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(bin)
+	}
+	httpReq, err := http.NewRequest(method, testServer.URL+"/api/v1"+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpRes, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRes.Body.Close()
+	if res != nil && httpRes.StatusCode < http.StatusMultipleChoices {
+		err = json.NewDecoder(httpRes.Body).Decode(res)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return httpRes.StatusCode
+}
+
+func TestAPIFlow(t *testing.T) {
+	account := map[string]string{
+		"name":     "api",
+		"email":    "api@example.com",
+		"password": "secret",
+	}
+	status := api(t, http.MethodPost, "/users", "", account, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("signup: %d", status)
+	}
+	status = api(t, http.MethodPost, "/users", "", account, nil)
+	if status != http.StatusConflict {
+		t.Errorf("second signup: %d", status)
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	status = api(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    account["email"],
+		"password": account["password"],
+	}, &token)
+	if status != http.StatusOK {
+		t.Fatalf("login: %d", status)
+	}
+
+	status = api(t, http.MethodPost, "/topics", "", map[string]string{
+		"topic": "anonymous",
+	}, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("topic without token: %d", status)
+	}
+	var topic struct {
+		Id         string `json:"id"`
+		NumReplies uint   `json:"num_replies"`
+	}
+	status = api(t, http.MethodPost, "/topics", token.Token, map[string]string{
+		"topic": "topic of api",
+	}, &topic)
+	if status != http.StatusCreated {
+		t.Fatalf("topic: %d", status)
+	}
+
+	path := "/topics/" + url.PathEscape(topic.Id)
+	status = api(t, http.MethodPost, path+"/replies", token.Token, map[string]string{
+		"body": "reply of api",
+	}, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("reply: %d", status)
+	}
+	var replies []struct {
+		Id   string `json:"id"`
+		Body string `json:"body"`
+	}
+	status = api(t, http.MethodGet, path+"/replies", "", nil, &replies)
+	if status != http.StatusOK || len(replies) != 1 || replies[0].Body != "reply of api" {
+		t.Fatalf("replies: %d %v", status, replies)
+	}
+	var me struct {
+		Id string `json:"id"`
+	}
+	status = api(t, http.MethodGet, "/me", token.Token, nil, &me)
+	if status != http.StatusOK {
+		t.Fatalf("me: %d", status)
+	}
+	// every resource has the id of the browser urls
+	for kind, id := range map[string]string{
+		"topic": topic.Id,
+		"reply": replies[0].Id,
+		"user":  me.Id,
+	} {
+		if !isPublicId(id) {
+			t.Errorf("%s id %q is not a url encoded uuid", kind, id)
+		}
+	}
+	// replies are counted after the reply is answered
+	deadline := time.Now().Add(5 * time.Second)
+	for topic.NumReplies != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		api(t, http.MethodGet, path, "", nil, &topic)
+	}
+	if topic.NumReplies != 1 {
+		t.Errorf("num_replies is %d", topic.NumReplies)
+	}
+
+	status = api(t, http.MethodPost, "/logout", token.Token, nil, nil)
+	if status != http.StatusNoContent {
+		t.Errorf("logout: %d", status)
+	}
+	status = api(t, http.MethodGet, "/me", token.Token, nil, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("me after logout: %d", status)
+	}
+}
+
+// isPublicId reports whether id is a uuid encoded as in /topic/read?id=
+func isPublicId(id string) bool {
+	bytes, err := base64.URLEncoding.DecodeString(id)
+	return err == nil && uuidPattern.Match(bytes)
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// loggedIn reports whether b is logged in, shown the form of new topic
+func (b *browser) loggedIn() bool {
+	b.t.Helper()
+	res, err := b.client.Get(testServer.URL + "/topic/new")
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+func (b *browser) login(email, password string) {
+	b.t.Helper()
+	status, _ := b.submit("/user/login", "/user/authenticate", url.Values{
+		"email":    {email},
+		"password": {password},
+	})
+	if status != http.StatusMovedPermanently {
+		b.t.Fatalf("login: %d", status)
+	}
+}
+
+func TestBrowserAndAPILoginsCoexist(t *testing.T) {
+	account := map[string]string{
+		"name":     "both",
+		"email":    "both@example.com",
+		"password": "secret",
+	}
+	status := api(t, http.MethodPost, "/users", "", account, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("signup: %d", status)
+	}
+	first := newBrowser(t)
+	first.login(account["email"], account["password"])
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	status = api(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    account["email"],
+		"password": account["password"],
+	}, &token)
+	if status != http.StatusOK {
+		t.Fatalf("api login: %d", status)
+	}
+	if !first.loggedIn() {
+		t.Error("api login ended browser login")
+	}
+
+	// ends the first browser login only
+	second := newBrowser(t)
+	second.login(account["email"], account["password"])
+	if first.loggedIn() || !second.loggedIn() {
+		t.Error("browser login did not replace the older one")
+	}
+
+	var me struct {
+		Id    string `json:"id"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	status = api(t, http.MethodGet, "/me", token.Token, nil, &me)
+	if status != http.StatusOK {
+		t.Fatalf("browser login ended api login: %d", status)
+	}
+	if me.Name != account["name"] || me.Email != account["email"] || len(me.Id) == 0 {
+		t.Errorf("me is %+v", me)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	res, err := http.Get(testServer.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("metrics on the public address: %d", res.StatusCode)
+	}
+
+	account := map[string]string{
+		"name":     "metrics",
+		"email":    "metrics@example.com",
+		"password": "secret",
+	}
+	api(t, http.MethodPost, "/users", "", account, nil)
+	api(t, http.MethodPost, "/users", "", account, nil)
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(
+		recorder,
+		httptest.NewRequest(http.MethodGet, "/metrics", nil),
+	)
+	body := recorder.Body.String()
+	for _, want := range []string{
+		`router_call_errors_total{code="conflict",function="createUser"}`,
+		fmt.Sprintf(
+			`rabbitrpc_queue_depth{queue="%s/%s"}`,
+			testConfig.UsersExchangeName,
+			testConfig.UsersServerKey,
+		),
+		`rabbitrpc_handler_errors_total{code="conflict",function="createUser"}`,
+		`http_request_duration_seconds_count{method="POST",route="/api/v1/users",status="409"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %s", want)
+		}
+	}
+}
@@ -1,100 +1,90 @@
 package common
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 	"unicode/utf8"
 
+	"learning-web-chatboard3/logging"
+	"learning-web-chatboard3/metrics"
 	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
 
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"xorm.io/xorm"
 )
 
-type Configuration struct {
-	AddressRouter string `json:"address_router"`
-
-	UsersExchangeName string `json:"Users_exchange_name"`
-	UsersReqQName     string `json:"users_req_q_name"`
-	UsersServerKey    string `json:"users_server_key"`
-	UsersResQName     string `json:"users_res_q_name"`
-	UsersClientKey    string `json:"users_client_key"`
-
-	SessionsExchangeName string `json:"sessions_exchange_name"`
-	SessionsReqQName     string `json:"sessions_req_q_name"`
-	SessionsServerKey    string `json:"sessions_server_key"`
-	SessionsResQName     string `json:"sessions_res_q_name"`
-	SessionsClientKey    string `json:"sessions_client_key"`
-
-	TopicsExchangeName string `json:"topics_exchange_name"`
-	TopicsReqQName     string `json:"topics_req_q_name"`
-	TopicsServerKey    string `json:"topics_server_key"`
-	TopicsResQName     string `json:"topics_res_q_name"`
-	TopicsClientKey    string `json:"topics_client_key"`
-
-	UseSecureCookie    bool   `json:"use_secure_cookie"`
-	SetHttpOnlyCookie  bool   `json:"set_http_only_cookie"`
-	DbName             string `json:"db_name"`
-	ShowSQL            bool   `json:"show_sql"`
-	LogToFile          bool   `json:"log_to_file"`
-	LogFileNameRouter  string `json:"log_file_name_router"`
-	LogFileNameUsers   string `json:"log_file_name_users"`
-	LogFileNameThreads string `json:"log_file_name_threads"`
-}
-
 type SimpleMessage struct {
 	Message string `json:"message"`
 }
 
 const (
-	ConfigFileName = "../config.json"
-	DbDriver       = "postgres"
-	DbParameter    = "dbname=%s user=%s password=%s host=localhost port=5432 sslmode=disable"
-)
+	DbDriverPostgres = "postgres"
+	DbDriverSQLite   = "sqlite3"
+	// no database, kept in memory of the process
+	DbDriverMemory = "memory"
 
-const (
-	LogInfoPrefix    = "[INFO]"
-	LogWarningPrefix = "[WARNING]"
-	LogErrorPrefix   = "[ERROR]"
+	DbParameter = "dbname=%s user=%s password=%s host=%s port=%d sslmode=%s"
+	// db_name is the file of sqlite3
+	SQLiteParameter = "file:%s?_foreign_keys=on&_busy_timeout=5000"
+
+	pqUniqueViolation = "23505"
+
+	// time given to in-flight requests on SIGINT or SIGTERM
+	ShutdownTimeout = time.Second * 10
 )
 
-func LoadConfig() (config *Configuration, err error) {
-	file, err := os.Open(ConfigFileName)
-	if err != nil {
-		return
-	}
-	decoder := json.NewDecoder(file)
-	config = &Configuration{}
-	err = decoder.Decode(config)
-	if err != nil {
-		return
-	}
-	return
+// NotifyShutdown returns context done on SIGINT or SIGTERM
+func NotifyShutdown() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(
+		context.Background(),
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
 }
 
+// OpenDb opens database of config.DbDriver, postgres or sqlite3.
 // set maxConn<=0 if use default
 func OpenDb(
-	dbName string,
-	showSQL bool,
+	config *Configuration,
 	maxConn int,
 ) (dbEngine *xorm.Engine, err error) {
-	dbEngine, err = xorm.NewEngine(
-		DbDriver,
-		fmt.Sprintf(
+	var dataSource string
+	switch config.DbDriver {
+	case DbDriverPostgres:
+		dataSource = fmt.Sprintf(
 			DbParameter,
-			dbName,
-			os.Getenv("DBUSER"),
-			os.Getenv("DBPASS"),
-		),
-	)
+			dsnValue(config.DbName),
+			dsnValue(config.DbUser),
+			dsnValue(config.DbPassword),
+			dsnValue(config.DbHost),
+			config.DbPort,
+			dsnValue(config.DbSSLMode),
+		)
+	case DbDriverSQLite:
+		dataSource = fmt.Sprintf(SQLiteParameter, config.DbName)
+		// sqlite3 allows one writer at a time
+		maxConn = 1
+	default:
+		err = fmt.Errorf("%s is not a database driver", config.DbDriver)
+		return
+	}
+
+	dbEngine, err = xorm.NewEngine(config.DbDriver, dataSource)
 	if err != nil {
 		return
 	}
-	dbEngine.ShowSQL(showSQL)
+	dbEngine.ShowSQL(config.ShowSQL)
+	dbEngine.AddHook(dbMetricsHook{})
 	if maxConn <= 0 {
 		maxConn = runtime.NumCPU()
 	}
@@ -102,42 +92,70 @@ func OpenDb(
 	return
 }
 
-func OpenLogger(logToFile bool, logFileName string) (logger *log.Logger, err error) {
-	if logToFile {
-		var file *os.File
-		file, err = os.OpenFile(
-			fmt.Sprintf("%s.log", logFileName),
-			os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-			0666,
-		)
-		if err != nil {
-			return
-		}
-		logger = log.New(
-			file,
-			LogInfoPrefix,
-			log.Ldate|log.Ltime|log.Lshortfile,
-		)
-	} else {
-		logger = log.Default()
-		logger.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	}
-	return
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// dsnValue quotes value of key=value connection string,
+// so that empty value or value with spaces is kept as is
+func dsnValue(value string) string {
+	return fmt.Sprint("'", dsnEscaper.Replace(value), "'")
 }
 
-func LogInfo(logger *log.Logger) *log.Logger {
-	logger.SetPrefix(LogInfoPrefix)
-	return logger
+// ServeMetrics serves /metrics on address in background.
+// does nothing if address is empty.
+func ServeMetrics(address string, logger *logging.Logger) {
+	if IsEmpty(address) {
+		return
+	}
+	go func() {
+		err := metrics.ListenAndServe(address)
+		logger.Error("metrics stopped", "address", address, "error", err)
+	}()
 }
 
-func LogWarning(logger *log.Logger) *log.Logger {
-	logger.SetPrefix(LogWarningPrefix)
-	return logger
+// IsUniqueViolation reports whether err is caused by unique constraint
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == pqUniqueViolation
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
 }
 
-func LogError(logger *log.Logger) *log.Logger {
-	logger.SetPrefix(LogErrorPrefix)
-	return logger
+// OpenLogger opens logger in format and level of config.
+// lines go to fileName rotated as configured if log_to_file is set,
+// otherwise to stderr.
+func OpenLogger(
+	config *Configuration,
+	fileName string,
+) (logger *logging.Logger, err error) {
+	format, err := logging.ParseFormat(config.LogFormat)
+	if err != nil {
+		return
+	}
+	level, err := logging.ParseLevel(config.LogLevel)
+	if err != nil {
+		return
+	}
+
+	var writer io.Writer = os.Stderr
+	if config.LogToFile {
+		writer, err = logging.OpenRotatingFile(
+			fileName,
+			int64(config.LogMaxSizeMB)*1024*1024,
+			time.Duration(config.LogMaxAgeHours)*time.Hour,
+			config.LogMaxBackups,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	logger = logging.New(writer, format, level)
+	return
 }
 
 func NewUuIdString() string {
@@ -154,28 +172,116 @@ func IsEmpty(str ...string) bool {
 	return false
 }
 
+var internalError = &rabbitrpc.RabbitRPCError{
+	What: "internal server error",
+}
+
+// ServeRequest decodes raws, calls the handler in registry
+// and sends the result back to the client.
+func ServeRequest(
+	server *rabbitrpc.RabbitClient,
+	registry *rabbitrpc.HandlerRegistry,
+	logger *logging.Logger,
+	raws rabbitrpc.Raws,
+) {
+	ctx := rabbitrpc.ContextFromRaws(context.Background(), &raws)
+	logger = logger.With("correlation_id", raws.CorrelationId)
+	logger = logger.With(rabbitrpc.TraceFields(ctx)...)
+
+	// ack after the reply is queued,
+	// unfinished request is redelivered to another instance
+	defer raws.Ack()
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err := fmt.Errorf("handler panicked: %v", r)
+		logger.Error("handler panicked", "panic", r)
+		retried, err := server.Retry(raws, err)
+		if err != nil {
+			logger.Error("cannot retry", "error", err)
+			return
+		}
+		if !retried {
+			logReplyError(logger, SendError(server, internalError, raws))
+		}
+	}()
+
+	envelop, e := rabbitrpc.FromRaws(&raws)
+	if e != nil {
+		// poison message, never retried
+		err := server.DeadLetter(raws, e)
+		if err != nil {
+			logger.Error("cannot quarantine", "error", err)
+			return
+		}
+		logReplyError(logger, SendError(server, e, raws))
+		return
+	}
+
+	logger = logger.With("function", envelop.FunctionToCall)
+	ctx = logging.WithLogger(ctx, logger)
+
+	dataPtr, dataName, err := registry.Dispatch(ctx, envelop)
+	if err != nil {
+		var rpcErr *rabbitrpc.RabbitRPCError
+		if errors.As(err, &rpcErr) {
+			logger.Warning(
+				"request failed",
+				"error", rpcErr.What,
+				"code", rpcErr.Code,
+			)
+			logReplyError(logger, SendError(server, rpcErr, raws))
+			return
+		}
+		HandleError(server, logger, err, raws)
+		return
+	}
+
+	logReplyError(logger, SendOK(server, dataPtr, dataName, raws))
+}
+
+// the client times out waiting for the lost reply
+func logReplyError(logger *logging.Logger, err error) {
+	if err != nil {
+		logger.Error("cannot reply", "error", err)
+	}
+}
+
 func HandleError(
 	server *rabbitrpc.RabbitClient,
-	logger *log.Logger,
-	loggerErrorMsg string,
-	corrId string,
+	logger *logging.Logger,
+	err error,
+	request rabbitrpc.Raws,
 ) {
-	LogError(logger).Println(loggerErrorMsg)
-	SendError(
-		server,
-		&rabbitrpc.RabbitRPCError{
-			What: "internal server error",
-		},
-		corrId,
-	)
+	logger.Error("request failed", "error", err)
+	logReplyError(logger, SendError(server, internalError, request))
 }
 
+// reply carries the trace of request back to the client
+func replyHeaders(request rabbitrpc.Raws) map[string]interface{} {
+	trace, ok := rabbitrpc.TraceFromRaws(&request)
+	if !ok {
+		return nil
+	}
+	return trace.Inject(nil)
+}
+
+// SendError answers request with e.
+// reply is encoded in the same way as request if possible.
+// fails once the publisher of server is done.
 func SendError(
 	server *rabbitrpc.RabbitClient,
 	e *rabbitrpc.RabbitRPCError,
-	corrId string,
-) {
-	bin, err := rabbitrpc.MakeBin(
+	request rabbitrpc.Raws,
+) error {
+	codec, _ := rabbitrpc.CodecFor(request.ContentType)
+	if codec == nil {
+		codec = rabbitrpc.JSONCodec
+	}
+	bin, err := rabbitrpc.MakeBinWith(
+		codec,
 		0,
 		rabbitrpc.StatusError,
 		"",
@@ -186,19 +292,30 @@ func SendError(
 		panic(err)
 	}
 
-	server.Publisher.Ch <- rabbitrpc.Raws{
+	return server.Send(rabbitrpc.Raws{
 		Body:          bin,
-		CorrelationId: corrId,
-	}
+		CorrelationId: request.CorrelationId,
+		ContentType:   codec.ContentType(),
+		RoutingKey:    request.ReplyTo,
+		Headers:       replyHeaders(request),
+	})
 }
 
+// SendOK answers request with dataPtr.
+// reply is encoded in the same way as request.
+// fails once the publisher of server is done.
 func SendOK(
 	server *rabbitrpc.RabbitClient,
 	dataPtr interface{},
 	dataName string,
-	corrId string,
-) {
-	bin, err := rabbitrpc.MakeBin(
+	request rabbitrpc.Raws,
+) error {
+	codec, e := rabbitrpc.CodecFor(request.ContentType)
+	if e != nil {
+		return SendError(server, e, request)
+	}
+	bin, err := rabbitrpc.MakeBinWith(
+		codec,
 		0,
 		rabbitrpc.StatusOK,
 		"",
@@ -209,8 +326,11 @@ func SendOK(
 		panic(err)
 	}
 
-	server.Publisher.Ch <- rabbitrpc.Raws{
+	return server.Send(rabbitrpc.Raws{
 		Body:          bin,
-		CorrelationId: corrId,
-	}
+		CorrelationId: request.CorrelationId,
+		ContentType:   codec.ContentType(),
+		RoutingKey:    request.ReplyTo,
+		Headers:       replyHeaders(request),
+	})
 }
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"context"
+	"io"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"testing"
+	"time"
+)
+
+func TestServeRequestAfterPublisherDone(t *testing.T) {
+	logger := logging.New(io.Discard, logging.FormatLogfmt, logging.LevelError)
+	rabbitrpc.SetLogger(logger)
+	broker := rabbitrpc.NewInProcBroker()
+
+	handled := make(chan struct{}, 1)
+	registry := rabbitrpc.NewHandlerRegistry()
+	rabbitrpc.Register(registry, "echo", func(
+		_ context.Context,
+		ping *rabbitrpc.Ping,
+	) (*rabbitrpc.Ping, error) {
+		handled <- struct{}{}
+		return ping, nil
+	})
+	var server *rabbitrpc.RabbitClient
+	server = rabbitrpc.NewRPCServerWithTransport(
+		broker,
+		"test.res",
+		"test.req",
+		"test",
+		rabbitrpc.ExchangeKindDirect,
+		"test.client",
+		"test.server",
+		rabbitrpc.Options{},
+		func(raws rabbitrpc.Raws) {
+			ServeRequest(server, registry, logger, raws)
+		},
+	)
+	client := rabbitrpc.NewRPCClientWithTransport(
+		broker,
+		"test.req",
+		"test.res",
+		"test",
+		rabbitrpc.ExchangeKindDirect,
+		"test.server",
+		"test.client",
+		rabbitrpc.Options{},
+		func(rabbitrpc.Raws) {},
+	)
+	defer client.Shutdown(context.Background())
+
+	// as when the publisher gave up dialing
+	server.Publisher.Done()
+	bin, e := rabbitrpc.MakeBin(
+		rabbitrpc.MethodCodeGET,
+		rabbitrpc.StatusOK,
+		"echo",
+		rabbitrpc.TypeName[rabbitrpc.Ping](),
+		&rabbitrpc.Ping{Status: "ok"},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	err := client.Send(rabbitrpc.Raws{
+		Body:          bin,
+		CorrelationId: client.GenerateCorrelationID(),
+		ContentType:   rabbitrpc.ContentTypeJSON,
+		ReplyTo:       client.SubscribeRoutingKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("request not handled")
+	}
+
+	// the request is acked though its reply cannot be sent
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("shutdown: %v, %d in flight", err, server.Inflight())
+	}
+}
@@ -0,0 +1,378 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+
+	"gopkg.in/yaml.v2"
+)
+
+// every field can be overridden by environment variable
+// named EnvPrefix + upper cased json name, e.g. CHATBOARD_DB_HOST
+type Configuration struct {
+	AddressRouter string `json:"address_router" yaml:"address_router"`
+	RabbitURL     string `json:"rabbit_url" yaml:"rabbit_url"`
+
+	UsersExchangeName string `json:"Users_exchange_name" yaml:"users_exchange_name"`
+	UsersReqQName     string `json:"users_req_q_name" yaml:"users_req_q_name"`
+	UsersServerKey    string `json:"users_server_key" yaml:"users_server_key"`
+	UsersResQName     string `json:"users_res_q_name" yaml:"users_res_q_name"`
+	UsersClientKey    string `json:"users_client_key" yaml:"users_client_key"`
+
+	SessionsExchangeName string `json:"sessions_exchange_name" yaml:"sessions_exchange_name"`
+	SessionsReqQName     string `json:"sessions_req_q_name" yaml:"sessions_req_q_name"`
+	SessionsServerKey    string `json:"sessions_server_key" yaml:"sessions_server_key"`
+	SessionsResQName     string `json:"sessions_res_q_name" yaml:"sessions_res_q_name"`
+	SessionsClientKey    string `json:"sessions_client_key" yaml:"sessions_client_key"`
+
+	TopicsExchangeName string `json:"topics_exchange_name" yaml:"topics_exchange_name"`
+	TopicsReqQName     string `json:"topics_req_q_name" yaml:"topics_req_q_name"`
+	TopicsServerKey    string `json:"topics_server_key" yaml:"topics_server_key"`
+	TopicsResQName     string `json:"topics_res_q_name" yaml:"topics_res_q_name"`
+	TopicsClientKey    string `json:"topics_client_key" yaml:"topics_client_key"`
+
+	UseSecureCookie   bool `json:"use_secure_cookie" yaml:"use_secure_cookie"`
+	SetHttpOnlyCookie bool `json:"set_http_only_cookie" yaml:"set_http_only_cookie"`
+	// keys of cookies and CSRF tokens, made by rotate-keys.
+	// key_ring is the content of the file, usually CHATBOARD_KEY_RING.
+	// router makes keys lost on restart if neither is set
+	KeyRingFile string `json:"key_ring_file" yaml:"key_ring_file"`
+	KeyRing     string `json:"key_ring" yaml:"key_ring"`
+
+	// postgres, sqlite3 or memory, postgres by default.
+	// db_name is the file of sqlite3.
+	// user and password default to DBUSER and DBPASS
+	DbDriver   string `json:"db_driver" yaml:"db_driver"`
+	DbName     string `json:"db_name" yaml:"db_name"`
+	DbHost     string `json:"db_host" yaml:"db_host"`
+	DbPort     int    `json:"db_port" yaml:"db_port"`
+	DbSSLMode  string `json:"db_sslmode" yaml:"db_sslmode"`
+	DbUser     string `json:"db_user" yaml:"db_user"`
+	DbPassword string `json:"db_password" yaml:"db_password"`
+	ShowSQL    bool   `json:"show_sql" yaml:"show_sql"`
+
+	// logfmt or json, info and above by default
+	LogFormat string `json:"log_format" yaml:"log_format"`
+	LogLevel  string `json:"log_level" yaml:"log_level"`
+	// stderr if false
+	LogToFile           bool   `json:"log_to_file" yaml:"log_to_file"`
+	LogFileNameRouter   string `json:"log_file_name_router" yaml:"log_file_name_router"`
+	LogFileNameUsers    string `json:"log_file_name_users" yaml:"log_file_name_users"`
+	LogFileNameTopics   string `json:"log_file_name_topics" yaml:"log_file_name_topics"`
+	LogFileNameSessions string `json:"log_file_name_sessions" yaml:"log_file_name_sessions"`
+	// rotation of log files, never rotated by size or age if 0,
+	// all rotated files kept if log_max_backups is 0
+	LogMaxSizeMB   int `json:"log_max_size_mb" yaml:"log_max_size_mb"`
+	LogMaxAgeHours int `json:"log_max_age_hours" yaml:"log_max_age_hours"`
+	LogMaxBackups  int `json:"log_max_backups" yaml:"log_max_backups"`
+
+	// codec of requests from router, json if empty.
+	// set application/msgpack only after every service knows it,
+	// services reply in the codec of the request
+	RPCContentType string `json:"rpc_content_type" yaml:"rpc_content_type"`
+	// shared by all services on the same broker
+	DurableQueues    bool `json:"durable_queues" yaml:"durable_queues"`
+	ServerPrefetch   int  `json:"server_prefetch" yaml:"server_prefetch"`
+	ServerMaxRetries int  `json:"server_max_retries" yaml:"server_max_retries"`
+
+	// /metrics of each process, disabled if empty.
+	// apart from address_router, keep them off the public network.
+	// all-in-one serves every metric on metrics_address_router
+	MetricsAddressRouter   string `json:"metrics_address_router" yaml:"metrics_address_router"`
+	MetricsAddressUsers    string `json:"metrics_address_users" yaml:"metrics_address_users"`
+	MetricsAddressTopics   string `json:"metrics_address_topics" yaml:"metrics_address_topics"`
+	MetricsAddressSessions string `json:"metrics_address_sessions" yaml:"metrics_address_sessions"`
+}
+
+const (
+	EnvPrefix = "CHATBOARD_"
+	// overrides ConfigFileName, --config flag wins over this
+	EnvConfigFile = "CHATBOARD_CONFIG"
+
+	DefaultDbHost    = "localhost"
+	DefaultDbPort    = 5432
+	DefaultDbSSLMode = "disable"
+
+	DefaultLogFormat = logging.FormatLogfmt
+	DefaultLogLevel  = "info"
+)
+
+// ConfigFileName is read by LoadConfig,
+// yaml if it ends with .yaml or .yml, otherwise json
+var ConfigFileName = "../config.json"
+
+var dbSSLModes = []string{
+	"disable",
+	"allow",
+	"prefer",
+	"require",
+	"verify-ca",
+	"verify-full",
+}
+
+// ConfigError reports every problem found in configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf(
+		"invalid configuration:\n  %s",
+		strings.Join(e.Problems, "\n  "),
+	)
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// ConfigFlag adds --config to command line flags,
+// call it before flag.Parse
+func ConfigFlag() {
+	if fileName, ok := os.LookupEnv(EnvConfigFile); ok {
+		ConfigFileName = fileName
+	}
+	flag.StringVar(
+		&ConfigFileName,
+		"config",
+		ConfigFileName,
+		"configuration file, json or yaml",
+	)
+}
+
+// LoadConfig reads ConfigFileName, applies defaults
+// and environment variables, then validates the result
+func LoadConfig() (config *Configuration, err error) {
+	bin, err := os.ReadFile(ConfigFileName)
+	if err != nil {
+		return
+	}
+
+	config = &Configuration{}
+	switch strings.ToLower(filepath.Ext(ConfigFileName)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(bin, config)
+	default:
+		// misspelled field is an error, as in yaml
+		decoder := json.NewDecoder(bytes.NewReader(bin))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot parse %s: %v", ConfigFileName, err)
+		return
+	}
+
+	config.setDefaults()
+	problems := &ConfigError{}
+	config.applyEnv(os.LookupEnv, problems)
+	config.validate(problems)
+	if len(problems.Problems) > 0 {
+		err = problems
+	}
+	return
+}
+
+func (config *Configuration) setDefaults() {
+	if IsEmpty(config.RabbitURL) {
+		config.RabbitURL = rabbitrpc.DefaultRabbitURL
+	}
+	if IsEmpty(config.DbDriver) {
+		config.DbDriver = DbDriverPostgres
+	}
+	if IsEmpty(config.DbHost) {
+		config.DbHost = DefaultDbHost
+	}
+	if config.DbPort == 0 {
+		config.DbPort = DefaultDbPort
+	}
+	if IsEmpty(config.DbSSLMode) {
+		config.DbSSLMode = DefaultDbSSLMode
+	}
+	if IsEmpty(config.LogFormat) {
+		config.LogFormat = string(DefaultLogFormat)
+	}
+	if IsEmpty(config.LogLevel) {
+		config.LogLevel = DefaultLogLevel
+	}
+	if IsEmpty(config.DbUser) {
+		config.DbUser = os.Getenv("DBUSER")
+	}
+	if IsEmpty(config.DbPassword) {
+		config.DbPassword = os.Getenv("DBPASS")
+	}
+}
+
+// EnvName is the environment variable overriding field of json name
+func EnvName(jsonName string) string {
+	return fmt.Sprint(EnvPrefix, strings.ToUpper(jsonName))
+}
+
+func (config *Configuration) applyEnv(
+	lookup func(key string) (string, bool),
+	problems *ConfigError,
+) {
+	val := reflect.ValueOf(config).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		jsonName := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		envName := EnvName(jsonName)
+		envVal, ok := lookup(envName)
+		if !ok {
+			continue
+		}
+
+		field := val.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(envVal)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(envVal)
+			if err != nil {
+				problems.add("%s: %q is not boolean", envName, envVal)
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(envVal)
+			if err != nil {
+				problems.add("%s: %q is not integer", envName, envVal)
+				continue
+			}
+			field.SetInt(int64(n))
+		}
+	}
+}
+
+func (config *Configuration) validate(problems *ConfigError) {
+	required := map[string]string{
+		"address_router":         config.AddressRouter,
+		"rabbit_url":             config.RabbitURL,
+		"users_exchange_name":    config.UsersExchangeName,
+		"users_req_q_name":       config.UsersReqQName,
+		"users_server_key":       config.UsersServerKey,
+		"users_res_q_name":       config.UsersResQName,
+		"users_client_key":       config.UsersClientKey,
+		"sessions_exchange_name": config.SessionsExchangeName,
+		"sessions_req_q_name":    config.SessionsReqQName,
+		"sessions_server_key":    config.SessionsServerKey,
+		"sessions_res_q_name":    config.SessionsResQName,
+		"sessions_client_key":    config.SessionsClientKey,
+		"topics_exchange_name":   config.TopicsExchangeName,
+		"topics_req_q_name":      config.TopicsReqQName,
+		"topics_server_key":      config.TopicsServerKey,
+		"topics_res_q_name":      config.TopicsResQName,
+		"topics_client_key":      config.TopicsClientKey,
+	}
+	switch config.DbDriver {
+	case DbDriverPostgres:
+		required["db_name"] = config.DbName
+		required["db_host"] = config.DbHost
+		required["db_user"] = config.DbUser
+	case DbDriverSQLite:
+		required["db_name"] = config.DbName
+	case DbDriverMemory:
+	default:
+		problems.add(
+			"db_driver: %q is not one of %s, %s, %s",
+			config.DbDriver,
+			DbDriverPostgres,
+			DbDriverSQLite,
+			DbDriverMemory,
+		)
+	}
+	if config.LogToFile {
+		required["log_file_name_router"] = config.LogFileNameRouter
+		required["log_file_name_users"] = config.LogFileNameUsers
+		required["log_file_name_topics"] = config.LogFileNameTopics
+		required["log_file_name_sessions"] = config.LogFileNameSessions
+	}
+	var missing []string
+	for name, val := range required {
+		if IsEmpty(val) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		problems.add("%s is required", name)
+	}
+
+	if !IsEmpty(config.RabbitURL) &&
+		!strings.HasPrefix(config.RabbitURL, "amqp://") &&
+		!strings.HasPrefix(config.RabbitURL, "amqps://") {
+		problems.add("rabbit_url: %q is not amqp:// or amqps://", config.RabbitURL)
+	}
+	if !IsEmpty(config.KeyRingFile) && !IsEmpty(config.KeyRing) {
+		problems.add("key_ring_file and key_ring are exclusive")
+	}
+	if config.DbPort < 1 || config.DbPort > 65535 {
+		problems.add("db_port: %d is out of range", config.DbPort)
+	}
+	if !containsString(dbSSLModes, config.DbSSLMode) {
+		problems.add(
+			"db_sslmode: %q is not one of %s",
+			config.DbSSLMode,
+			strings.Join(dbSSLModes, ", "),
+		)
+	}
+	if _, err := logging.ParseFormat(config.LogFormat); err != nil {
+		problems.add("log_format: %v", err)
+	}
+	if _, err := logging.ParseLevel(config.LogLevel); err != nil {
+		problems.add("log_level: %v", err)
+	}
+	if config.LogMaxSizeMB < 0 {
+		problems.add("log_max_size_mb: %d is negative", config.LogMaxSizeMB)
+	}
+	if config.LogMaxAgeHours < 0 {
+		problems.add("log_max_age_hours: %d is negative", config.LogMaxAgeHours)
+	}
+	if config.LogMaxBackups < 0 {
+		problems.add("log_max_backups: %d is negative", config.LogMaxBackups)
+	}
+	if !IsEmpty(config.RPCContentType) {
+		if _, e := rabbitrpc.CodecFor(config.RPCContentType); e != nil {
+			problems.add("rpc_content_type: %s", e.What)
+		}
+	}
+	if config.ServerPrefetch < 0 {
+		problems.add("server_prefetch: %d is negative", config.ServerPrefetch)
+	}
+	if config.ServerMaxRetries < 0 {
+		problems.add("server_max_retries: %d is negative", config.ServerMaxRetries)
+	}
+}
+
+func (config *Configuration) RabbitOptions() rabbitrpc.Options {
+	return rabbitrpc.Options{
+		Durable:    config.DurableQueues,
+		Prefetch:   config.ServerPrefetch,
+		MaxRetries: config.ServerMaxRetries,
+	}
+}
+
+// RabbitTransport talks to RabbitMQ at RabbitURL
+func (config *Configuration) RabbitTransport() rabbitrpc.Transport {
+	return rabbitrpc.NewAMQPTransport(config.RabbitURL)
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useConfig makes LoadConfig read config.json of the repository
+// changed by edit, written to a temporary file
+func useConfig(t *testing.T, edit func(fields map[string]interface{})) {
+	t.Helper()
+	bin, err := os.ReadFile("../config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(bin, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields["db_driver"] = DbDriverMemory
+	edit(fields)
+	bin, err = json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(fileName, bin, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := ConfigFileName
+	ConfigFileName = fileName
+	t.Cleanup(func() { ConfigFileName = saved })
+}
+
+func problemsOf(t *testing.T, err error) []string {
+	t.Helper()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("not ConfigError: %v", err)
+	}
+	return configErr.Problems
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	useConfig(t, func(map[string]interface{}) {})
+	t.Setenv(EnvName("db_driver"), DbDriverSQLite)
+	t.Setenv(EnvName("db_name"), "chatboard.db")
+	t.Setenv(EnvName("db_port"), "6543")
+	t.Setenv(EnvName("use_secure_cookie"), "false")
+	t.Setenv(EnvName("users_exchange_name"), "users-env")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DbDriver != DbDriverSQLite ||
+		config.DbName != "chatboard.db" ||
+		config.DbPort != 6543 ||
+		config.UseSecureCookie ||
+		config.UsersExchangeName != "users-env" {
+		t.Errorf("loaded %+v", config)
+	}
+}
+
+func TestLoadConfigEnvInvalid(t *testing.T) {
+	useConfig(t, func(map[string]interface{}) {})
+	t.Setenv(EnvName("db_port"), "port")
+	t.Setenv(EnvName("use_secure_cookie"), "yes please")
+
+	_, err := LoadConfig()
+	problems := problemsOf(t, err)
+	if len(problems) != 2 ||
+		!strings.HasPrefix(problems[0], EnvName("use_secure_cookie")) ||
+		!strings.HasPrefix(problems[1], EnvName("db_port")) {
+		t.Errorf("problems %q", problems)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	useConfig(t, func(fields map[string]interface{}) {
+		delete(fields, "topics_req_q_name")
+		fields["users_client_key"] = ""
+		fields["rabbit_url"] = "http://localhost"
+		fields["db_port"] = 70000
+		fields["log_level"] = "loud"
+		fields["rpc_content_type"] = "text/plain"
+	})
+
+	_, err := LoadConfig()
+	problems := problemsOf(t, err)
+	for _, want := range []string{
+		"topics_req_q_name is required",
+		"users_client_key is required",
+		"rabbit_url:",
+		"db_port:",
+		"log_level:",
+		"rpc_content_type:",
+	} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, want)
+		}
+		if !found {
+			t.Errorf("%q not in %q", want, problems)
+		}
+	}
+	if len(problems) != 6 {
+		t.Errorf("problems %q", problems)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	useConfig(t, func(fields map[string]interface{}) {
+		fields["db_sslmod"] = "require"
+	})
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "db_sslmod") {
+		t.Errorf("json: %v", err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "config.yaml")
+	err = os.WriteFile(fileName, []byte("db_sslmod: require\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfigFileName = fileName
+	_, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "db_sslmod") {
+		t.Errorf("yaml: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"xorm.io/xorm/contexts"
+)
+
+var dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "db_query_duration_seconds",
+	Help: "Time spent by database queries by statement.",
+}, []string{"statement"})
+
+var dbQueryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_query_errors_total",
+	Help: "Failed database queries by statement.",
+}, []string{"statement"})
+
+// dbMetricsHook observes every query run by xorm engine
+type dbMetricsHook struct{}
+
+func (dbMetricsHook) BeforeProcess(c *contexts.ContextHook) (context.Context, error) {
+	return c.Ctx, nil
+}
+
+func (dbMetricsHook) AfterProcess(c *contexts.ContextHook) error {
+	statement := statementOf(c.SQL)
+	dbQueryDuration.WithLabelValues(statement).Observe(c.ExecuteTime.Seconds())
+	if c.Err != nil {
+		dbQueryErrors.WithLabelValues(statement).Inc()
+	}
+	return nil
+}
+
+// statementOf is the first keyword of query, lower cased
+func statementOf(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToLower(fields[0])
+}
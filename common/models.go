@@ -6,35 +6,40 @@ import (
 )
 
 type User struct {
-	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
-	UuId      string    `xorm:"not null unique 'uu_id'" json:"uuid"`
-	Name      string    `xorm:"not null unique 'name'" json:"name"`
-	Email     string    `xorm:"not null unique 'email'" json:"email"`
+	Id    uint   `xorm:"pk autoincr 'id'" json:"id"`
+	UuId  string `xorm:"not null unique 'uu_id'" json:"uuid"`
+	Name  string `xorm:"not null unique 'name'" json:"name"`
+	Email string `xorm:"not null unique 'email'" json:"email"`
+	// encoded with algorithm and parameters of the hash
 	Password  string    `xorm:"not null 'password'" json:"password"`
-	Salt      string    `xorm:"not null 'salt'" json:"salt"`
 	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
 // this is private session
 // linked with user
 type Login struct {
-	Id         uint      `xorm:"pk autoincr 'id'" json:"id"`
-	UuId       string    `xorm:"not null unique 'uu_id'" json:"uuid"`
-	UserName   string    `xorm:"user_name" json:"user_name"`
-	UserId     uint      `xorm:"user_id" json:"user_id"`
-	State      string    `xorm:"TEXT 'state'" json:"state"`
+	Id       uint   `xorm:"pk autoincr 'id'" json:"id"`
+	UuId     string `xorm:"not null unique 'uu_id'" json:"uuid"`
+	UserName string `xorm:"user_name" json:"user_name"`
+	UserId   uint   `xorm:"user_id" json:"user_id"`
+	// LoginKindBrowser or LoginKindAPI
+	Kind       string    `xorm:"not null 'kind'" json:"kind"`
 	LastUpdate time.Time `xorm:"not null 'last_update'" json:"last_update"`
 	CreatedAt  time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
+// logins of the cookie and of bearer tokens,
+// a new login ends only others of the same kind
+const (
+	LoginKindBrowser = "browser"
+	LoginKindAPI     = "api"
+)
+
 // this is public session
 // NOT linked with user
 type Session struct {
 	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
 	UuId      string    `xorm:"not null unique 'uu_id'" json:"uuid"`
-	State     string    `xorm:"TEXT 'state'" json:"state"`
-	TopicId   uint      `xorm:"topic_id" json:"topic_id"`
-	TopicUuId string    `xorm:"topic_uu_id" json:"topic_uuid"`
 	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
@@ -50,7 +55,7 @@ type Topic struct {
 }
 
 type Reply struct {
-	Id          uint      `xorm:"ok autoincr 'id'" json:"id"`
+	Id          uint      `xorm:"pk autoincr 'id'" json:"id"`
 	UuId        string    `xorm:"not null unique 'uu_id'" json:"uuid"`
 	Body        string    `xorm:"TEXT 'body'" json:"body"`
 	Contributor string    `xorm:"contributor" json:"contributor"`
@@ -70,3 +75,11 @@ func (reply *Reply) When() string {
 func (topic *Topic) AsURL() string {
 	return base64.URLEncoding.EncodeToString([]byte(topic.UuId))
 }
+
+func (reply *Reply) AsURL() string {
+	return base64.URLEncoding.EncodeToString([]byte(reply.UuId))
+}
+
+func (user *User) AsURL() string {
+	return base64.URLEncoding.EncodeToString([]byte(user.UuId))
+}
@@ -0,0 +1,229 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"learning-web-chatboard3/common"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// keys of router encrypting cookies and signing cookies and CSRF tokens.
+// values carry the id of the key that made them,
+// so that they still validate after a new primary key is added.
+// the primary key makes every new value, other keys only validate.
+// a new key is added verify-only and promoted to primary later,
+// once every router knows it, then the old one is retired.
+
+const (
+	CipherKeySize = 32 // AES-256
+	MACKeySize    = 64 // HMAC-SHA256
+	idSize        = 4
+	// separates the key id in values made by a key
+	idSeparator = "."
+)
+
+var (
+	// neither key_ring_file nor key_ring is set
+	ErrNotConfigured  = errors.New("key ring is not configured")
+	ErrUnknownKey     = errors.New("unknown key")
+	ErrRetirePrimary  = errors.New("primary key cannot be retired")
+	ErrKeyIdSeparator = errors.New("key id contains " + idSeparator)
+)
+
+type Key struct {
+	Id        string    `json:"id"`
+	Cipher    []byte    `json:"cipher"`
+	MAC       []byte    `json:"mac"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Ring is stored as json, keys are base64 encoded
+type Ring struct {
+	Primary string `json:"primary"`
+	Keys    []Key  `json:"keys"`
+}
+
+// Open reads ring of config.KeyRingFile or config.KeyRing
+func Open(config *common.Configuration) (ring *Ring, err error) {
+	switch {
+	case !common.IsEmpty(config.KeyRingFile):
+		return Load(config.KeyRingFile)
+	case !common.IsEmpty(config.KeyRing):
+		return Parse([]byte(config.KeyRing))
+	default:
+		err = ErrNotConfigured
+		return
+	}
+}
+
+// New returns ring of one new primary key
+func New() (ring *Ring, err error) {
+	ring = &Ring{}
+	_, err = ring.Add()
+	return
+}
+
+func Load(fileName string) (ring *Ring, err error) {
+	bin, err := os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	ring, err = Parse(bin)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", fileName, err)
+	}
+	return
+}
+
+func Parse(bin []byte) (ring *Ring, err error) {
+	ring = &Ring{}
+	err = json.Unmarshal(bin, ring)
+	if err != nil {
+		err = fmt.Errorf("cannot parse key ring: %w", err)
+		return
+	}
+	err = ring.validate()
+	return
+}
+
+func (ring *Ring) validate() error {
+	seen := make(map[string]bool, len(ring.Keys))
+	for _, key := range ring.Keys {
+		switch {
+		case common.IsEmpty(key.Id):
+			return errors.New("key without id")
+		case strings.Contains(key.Id, idSeparator):
+			return fmt.Errorf("key %s: %w", key.Id, ErrKeyIdSeparator)
+		case seen[key.Id]:
+			return fmt.Errorf("key %s: duplicated", key.Id)
+		case len(key.Cipher) != CipherKeySize:
+			return fmt.Errorf("key %s: cipher is not %d bytes", key.Id, CipherKeySize)
+		case len(key.MAC) != MACKeySize:
+			return fmt.Errorf("key %s: mac is not %d bytes", key.Id, MACKeySize)
+		}
+		seen[key.Id] = true
+	}
+	if !seen[ring.Primary] {
+		return fmt.Errorf("primary %q: %w", ring.Primary, ErrUnknownKey)
+	}
+	return nil
+}
+
+// Save writes ring readable only by its owner,
+// replacing fileName at once
+func (ring *Ring) Save(fileName string) (err error) {
+	bin, err := ring.Marshal()
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), ".keyring-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(bin)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), fileName)
+	return
+}
+
+func (ring *Ring) Marshal() ([]byte, error) {
+	bin, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(bin, '\n'), nil
+}
+
+// Add adds a new verify-only key, see Promote.
+// the first key of an empty ring is primary at once.
+func (ring *Ring) Add() (key *Key, err error) {
+	key = &Key{
+		Cipher:    make([]byte, CipherKeySize),
+		MAC:       make([]byte, MACKeySize),
+		CreatedAt: time.Now().UTC(),
+	}
+	for common.IsEmpty(key.Id) || ring.Lookup(key.Id) != nil {
+		key.Id, err = newId()
+		if err != nil {
+			return
+		}
+	}
+	_, err = rand.Read(key.Cipher)
+	if err != nil {
+		return
+	}
+	_, err = rand.Read(key.MAC)
+	if err != nil {
+		return
+	}
+	ring.Keys = append(ring.Keys, *key)
+	if len(ring.Keys) == 1 {
+		ring.Primary = key.Id
+	}
+	return
+}
+
+// Promote makes key of id primary.
+// every router has to know the key before,
+// or values it makes are invalid on the others.
+func (ring *Ring) Promote(id string) error {
+	if ring.Lookup(id) == nil {
+		return fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	ring.Primary = id
+	return nil
+}
+
+// Retire removes key of id,
+// values made by it are no longer valid
+func (ring *Ring) Retire(id string) error {
+	if id == ring.Primary {
+		return ErrRetirePrimary
+	}
+	for i := range ring.Keys {
+		if ring.Keys[i].Id == id {
+			ring.Keys = append(ring.Keys[:i], ring.Keys[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q", ErrUnknownKey, id)
+}
+
+// Lookup is key of id, nil if none
+func (ring *Ring) Lookup(id string) *Key {
+	for i := range ring.Keys {
+		if ring.Keys[i].Id == id {
+			return &ring.Keys[i]
+		}
+	}
+	return nil
+}
+
+func (ring *Ring) PrimaryKey() *Key {
+	return ring.Lookup(ring.Primary)
+}
+
+func newId() (string, error) {
+	bin := make([]byte, idSize)
+	_, err := rand.Read(bin)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bin), nil
+}
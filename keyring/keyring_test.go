@@ -0,0 +1,128 @@
+package keyring
+
+import (
+	"errors"
+	"learning-web-chatboard3/common"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	ring, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ring.Primary
+
+	key, err := ring.Add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Primary != old || ring.Lookup(key.Id) == nil {
+		t.Fatalf("added %s, primary is %s", key.Id, ring.Primary)
+	}
+	err = ring.Retire(old)
+	if !errors.Is(err, ErrRetirePrimary) {
+		t.Errorf("retired primary: %v", err)
+	}
+	err = ring.Promote("unknown")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("promoted unknown key: %v", err)
+	}
+
+	err = ring.Promote(key.Id)
+	if err != nil || ring.PrimaryKey().Id != key.Id {
+		t.Fatalf("promoted %s: %v", key.Id, err)
+	}
+	err = ring.Retire(old)
+	if err != nil || ring.Lookup(old) != nil || len(ring.Keys) != 1 {
+		t.Errorf("retired %s: %v", old, err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	ring, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ring.Add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "keyring.json")
+	err = ring.Save(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("saved %v: %v", info.Mode(), err)
+	}
+
+	for _, config := range []*common.Configuration{
+		{KeyRingFile: fileName},
+		{KeyRing: mustMarshal(t, ring)},
+	} {
+		loaded, err := Open(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Primary != ring.Primary || len(loaded.Keys) != 2 {
+			t.Fatalf("loaded %+v", loaded)
+		}
+		for i, key := range loaded.Keys {
+			if string(key.Cipher) != string(ring.Keys[i].Cipher) ||
+				string(key.MAC) != string(ring.Keys[i].MAC) {
+				t.Errorf("key %s changed", key.Id)
+			}
+		}
+	}
+	_, err = Open(&common.Configuration{})
+	if !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("not configured: %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, ring *Ring) string {
+	t.Helper()
+	bin, err := ring.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bin)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(ring *Ring)
+		err  string
+	}{
+		{"no id", func(ring *Ring) { ring.Keys[1].Id = "" }, "without id"},
+		{"dotted id", func(ring *Ring) { ring.Keys[1].Id = "a.b" }, "contains"},
+		{"duplicated", func(ring *Ring) { ring.Keys[1].Id = ring.Keys[0].Id }, "duplicated"},
+		{"short cipher", func(ring *Ring) { ring.Keys[1].Cipher = ring.Keys[1].Cipher[1:] }, "cipher"},
+		{"short mac", func(ring *Ring) { ring.Keys[1].MAC = nil }, "mac"},
+		{"unknown primary", func(ring *Ring) { ring.Primary = "unknown" }, "unknown key"},
+	} {
+		ring, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ring.Add()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.edit(ring)
+		_, err = Parse([]byte(mustMarshal(t, ring)))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+	_, err := Parse([]byte("{"))
+	if err == nil {
+		t.Error("parsed broken json")
+	}
+}
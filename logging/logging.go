@@ -0,0 +1,284 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structured and leveled logger.
+// a line is written at once under a lock,
+// so loggers sharing an output never mix their lines.
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+}
+
+// ParseLevel reads debug, info, warning or error
+func ParseLevel(str string) (Level, error) {
+	for level := LevelDebug; level <= LevelError; level++ {
+		if strings.EqualFold(str, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", str)
+}
+
+type Format string
+
+const (
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+func ParseFormat(str string) (Format, error) {
+	switch Format(strings.ToLower(str)) {
+	case FormatLogfmt:
+		return FormatLogfmt, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	default:
+		return FormatLogfmt, fmt.Errorf("unknown log format %q", str)
+	}
+}
+
+// output is shared by a logger and every logger derived from it
+type output struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format Format
+	level  Level
+}
+
+type Logger struct {
+	out *output
+	// key value pairs put on every line
+	fields []interface{}
+}
+
+func New(writer io.Writer, format Format, level Level) *Logger {
+	return &Logger{
+		out: &output{
+			writer: writer,
+			format: format,
+			level:  level,
+		},
+	}
+}
+
+var defaultLogger = New(os.Stderr, FormatLogfmt, LevelInfo)
+
+// Default writes logfmt to stderr from info level
+func Default() *Logger {
+	return defaultLogger
+}
+
+// With returns logger which adds keyvals to every line
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+	if len(keyvals) == 0 {
+		return logger
+	}
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyvals))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{
+		out:    logger.out,
+		fields: fields,
+	}
+}
+
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= logger.out.level
+}
+
+func (logger *Logger) Debug(msg string, keyvals ...interface{}) {
+	logger.log(LevelDebug, msg, keyvals)
+}
+
+func (logger *Logger) Info(msg string, keyvals ...interface{}) {
+	logger.log(LevelInfo, msg, keyvals)
+}
+
+func (logger *Logger) Warning(msg string, keyvals ...interface{}) {
+	logger.log(LevelWarning, msg, keyvals)
+}
+
+func (logger *Logger) Error(msg string, keyvals ...interface{}) {
+	logger.log(LevelError, msg, keyvals)
+}
+
+// Fatal logs at error level then exits
+func (logger *Logger) Fatal(msg string, keyvals ...interface{}) {
+	logger.log(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+// caller of Debug, Info and others
+const callerDepth = 2
+
+func (logger *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+
+	caller := "???"
+	_, file, line, ok := runtime.Caller(callerDepth)
+	if ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	pairs := make([]interface{}, 0, 8+len(logger.fields)+len(keyvals))
+	pairs = append(
+		pairs,
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+		"caller", caller,
+	)
+	pairs = append(pairs, logger.fields...)
+	pairs = append(pairs, keyvals...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "!MISSING")
+	}
+
+	var buf bytes.Buffer
+	switch logger.out.format {
+	case FormatJSON:
+		encodeJSON(&buf, pairs)
+	default:
+		encodeLogfmt(&buf, pairs)
+	}
+	buf.WriteByte('\n')
+
+	logger.out.mutex.Lock()
+	defer logger.out.mutex.Unlock()
+	logger.out.writer.Write(buf.Bytes())
+}
+
+// encoding //////////////////////////////////////////////////////
+
+func keyOf(key interface{}) string {
+	if str, ok := key.(string); ok {
+		return str
+	}
+	return fmt.Sprint(key)
+}
+
+// plain is value as string or value json can encode as is
+func plain(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case time.Duration:
+		return v.String()
+	case string, bool,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return v
+	default:
+		return fmt.Sprintf("%+v", v)
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(keyOf(pairs[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(plain(pairs[i+1]))
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(pairs[i+1]))
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmt(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtKey(keyOf(pairs[i])))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(plain(pairs[i+1])))
+	}
+}
+
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+func logfmtValue(val interface{}) string {
+	if val == nil {
+		return "null"
+	}
+	str, ok := val.(string)
+	if !ok {
+		return fmt.Sprint(val)
+	}
+	if str == "" || strings.ContainsAny(str, " =\"\\\t\r\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// context ///////////////////////////////////////////////////////
+
+type loggerKey struct{}
+
+// WithLogger puts logger in ctx for handlers deeper in the call
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext is the logger in ctx, or fallback if none
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return logger
+	}
+	return fallback
+}
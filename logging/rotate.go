@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log file rotated by size and age.
+// the rotated file is renamed with the time of rotation,
+// and only the newest MaxBackups of them are kept.
+
+const rotatedTimeFormat = "20060102-150405.000"
+
+type RotatingFile struct {
+	Name string
+	// rotate when the file would exceed MaxSize bytes, never if <= 0
+	MaxSize int64
+	// rotate when the file is older than MaxAge, never if <= 0
+	MaxAge time.Duration
+	// rotated files kept, all if <= 0
+	MaxBackups int
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func OpenRotatingFile(
+	name string,
+	maxSize int64,
+	maxAge time.Duration,
+	maxBackups int,
+) (rotating *RotatingFile, err error) {
+	rotating = &RotatingFile{
+		Name:       name,
+		MaxSize:    maxSize,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+	}
+	err = rotating.open()
+	return
+}
+
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(
+		rotating.Name,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0666,
+	)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	// age of existing file is counted from its modification
+	rotating.opened = info.ModTime()
+	if info.Size() == 0 {
+		rotating.opened = time.Now()
+	}
+	return nil
+}
+
+func (rotating *RotatingFile) Write(p []byte) (n int, err error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file != nil && rotating.needsRotation(int64(len(p))) {
+		err = rotating.rotate()
+		if err != nil && rotating.file != nil {
+			// the log is kept on in the file not rotated,
+			// rotation is tried again by the next write
+			fmt.Fprintln(os.Stderr, "cannot rotate log:", err)
+			err = nil
+		}
+	}
+	if rotating.file == nil {
+		err = rotating.open()
+		if err != nil {
+			return
+		}
+	}
+	n, err = rotating.file.Write(p)
+	rotating.size += int64(n)
+	return
+}
+
+func (rotating *RotatingFile) needsRotation(writing int64) bool {
+	if rotating.size == 0 {
+		return false
+	}
+	if rotating.MaxSize > 0 && rotating.size+writing > rotating.MaxSize {
+		return true
+	}
+	if rotating.MaxAge > 0 && time.Since(rotating.opened) > rotating.MaxAge {
+		return true
+	}
+	return false
+}
+
+// rotate renames the file and opens a new one.
+// on any failure the original file is opened again,
+// and rotating.file is nil only if that fails too
+func (rotating *RotatingFile) rotate() (err error) {
+	err = rotating.file.Close()
+	rotating.file = nil
+	if err == nil {
+		rotated := fmt.Sprintf(
+			"%s.%s",
+			rotating.Name,
+			time.Now().Format(rotatedTimeFormat),
+		)
+		err = os.Rename(rotating.Name, rotated)
+	}
+	if err == nil {
+		rotating.removeOldBackups()
+	}
+	openErr := rotating.open()
+	if err == nil {
+		err = openErr
+	}
+	return
+}
+
+func (rotating *RotatingFile) removeOldBackups() {
+	if rotating.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(fmt.Sprint(rotating.Name, ".*"))
+	if err != nil {
+		return
+	}
+	prefix := fmt.Sprint(rotating.Name, ".")
+	var rotated []string
+	for _, backup := range backups {
+		stamp := strings.TrimPrefix(backup, prefix)
+		if _, e := time.Parse(rotatedTimeFormat, stamp); e == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	// time format sorts in time order
+	sort.Strings(rotated)
+	for len(rotated) > rotating.MaxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	return rotating.file.Close()
+}
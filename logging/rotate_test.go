@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateFailureKeepsLogging(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	rotating, err := OpenRotatingFile(name, 8, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotating.Close()
+	_, err = rotating.Write([]byte("first\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// renaming a removed file fails
+	err = os.Remove(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = rotating.Write([]byte("second\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "second\n" {
+		t.Errorf("written %q", written)
+	}
+}
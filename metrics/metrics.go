@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are made with prometheus client by whoever observes them,
+// registered to its default registry at package init.
+// this package only serves them.
+
+// Handler answers every registered metric in prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ListenAndServe serves /metrics on address,
+// apart from the http server open to users
+func ListenAndServe(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(address, mux)
+}
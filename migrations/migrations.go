@@ -0,0 +1,310 @@
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// numbered migrations of the database schema.
+// sql/<driver>/NNNN_name.up.sql moves the schema to version NNNN,
+// sql/<driver>/NNNN_name.down.sql moves it back to the version before.
+// every driver has the same versions.
+// applied versions are recorded in schema_migrations.
+
+//go:embed sql/*/*.sql
+var sqlFiles embed.FS
+
+const (
+	sqlDir = "sql"
+
+	createTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version    INTEGER PRIMARY KEY,
+  name       VARCHAR(255) NOT NULL,
+  applied_at TIMESTAMP NOT NULL
+)`
+	versionSQL = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+	insertSQL  = "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"
+	deleteSQL  = "DELETE FROM schema_migrations WHERE version = ?"
+)
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// VersionMismatchError is returned by Check
+// when the database is not at the version this build expects
+type VersionMismatchError struct {
+	Current  int
+	Expected int
+}
+
+func (e *VersionMismatchError) Error() string {
+	if e.Current < e.Expected {
+		return fmt.Sprintf(
+			"database schema is at version %d, %d expected, run chatboard migrate up",
+			e.Current,
+			e.Expected,
+		)
+	}
+	return fmt.Sprintf(
+		"database schema is at version %d, newer than %d expected by this build",
+		e.Current,
+		e.Expected,
+	)
+}
+
+// migrations of every driver by driver name
+var all = mustLoadAll()
+
+func mustLoadAll() map[string][]Migration {
+	drivers, err := sqlFiles.ReadDir(sqlDir)
+	if err != nil {
+		panic(err)
+	}
+	all := make(map[string][]Migration)
+	expected := -1
+	for _, driver := range drivers {
+		migrations, err := load(sqlFiles, driver.Name())
+		if err != nil {
+			panic(err)
+		}
+		if expected >= 0 && len(migrations) != expected {
+			panic(fmt.Errorf(
+				"%s has %d migrations, others have %d",
+				driver.Name(),
+				len(migrations),
+				expected,
+			))
+		}
+		expected = len(migrations)
+		all[driver.Name()] = migrations
+	}
+	return all
+}
+
+// load reads migrations of driver from fsys in order of version,
+// every version must have both up and down
+func load(fsys fs.FS, driver string) (migrations []Migration, err error) {
+	dir := path.Join(sqlDir, driver)
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			err = fmt.Errorf("migration %s is not NNNN_name.up|down.sql", entry.Name())
+			return
+		}
+		version, _ := strconv.Atoi(match[1])
+		var bin []byte
+		bin, err = fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			err = fmt.Errorf("migration %d has two names", version)
+			return
+		}
+		if match[3] == "up" {
+			migration.Up = string(bin)
+		} else {
+			migration.Down = string(bin)
+		}
+	}
+
+	for _, migration := range byVersion {
+		if len(migration.Up) == 0 || len(migration.Down) == 0 {
+			err = fmt.Errorf("migration %d lacks up or down", migration.Version)
+			return
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			err = fmt.Errorf("migration %d is missing", i+1)
+			return
+		}
+	}
+	return
+}
+
+// For is every migration of database of dbEngine in order of version
+func For(dbEngine *xorm.Engine) ([]Migration, error) {
+	driver := string(dbEngine.Dialect().URI().DBType)
+	migrations, ok := all[driver]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for %s", driver)
+	}
+	return migrations, nil
+}
+
+// Expected is the schema version this build works with
+func Expected() int {
+	for _, migrations := range all {
+		return len(migrations)
+	}
+	return 0
+}
+
+// Version is the schema version of the database, 0 if none applied
+func Version(dbEngine *xorm.Engine) (version int, err error) {
+	_, err = dbEngine.Exec(createTableSQL)
+	if err != nil {
+		return
+	}
+	_, err = dbEngine.SQL(versionSQL).Get(&version)
+	return
+}
+
+// Check fails unless the database is at the expected version.
+// services call it at startup.
+func Check(dbEngine *xorm.Engine) error {
+	version, err := Version(dbEngine)
+	if err != nil {
+		return err
+	}
+	if version != Expected() {
+		return &VersionMismatchError{
+			Current:  version,
+			Expected: Expected(),
+		}
+	}
+	return nil
+}
+
+// Up applies every migration not applied yet,
+// each in its own transaction
+func Up(dbEngine *xorm.Engine) (applied []Migration, err error) {
+	migrations, err := For(dbEngine)
+	if err != nil {
+		return
+	}
+	version, err := Version(dbEngine)
+	if err != nil {
+		return
+	}
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		err = run(
+			dbEngine,
+			migration.Up,
+			insertSQL,
+			migration.Version,
+			migration.Name,
+			time.Now(),
+		)
+		if err != nil {
+			err = fmt.Errorf("migration %d up: %w", migration.Version, err)
+			return
+		}
+		applied = append(applied, migration)
+	}
+	return
+}
+
+// Down reverts the latest applied migration,
+// nil if no migration is applied
+func Down(dbEngine *xorm.Engine) (reverted *Migration, err error) {
+	migrations, err := For(dbEngine)
+	if err != nil {
+		return
+	}
+	version, err := Version(dbEngine)
+	if err != nil || version == 0 {
+		return
+	}
+	if version > Expected() {
+		err = &VersionMismatchError{
+			Current:  version,
+			Expected: Expected(),
+		}
+		return
+	}
+	migration := migrations[version-1]
+	err = run(dbEngine, migration.Down, deleteSQL, migration.Version)
+	if err != nil {
+		err = fmt.Errorf("migration %d down: %w", migration.Version, err)
+		return
+	}
+	reverted = &migration
+	return
+}
+
+// Status lists every migration with whether it is applied
+func Status(dbEngine *xorm.Engine) (statuses []MigrationStatus, err error) {
+	migrations, err := For(dbEngine)
+	if err != nil {
+		return
+	}
+	version, err := Version(dbEngine)
+	if err != nil {
+		return
+	}
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Migration: migration,
+			Applied:   migration.Version <= version,
+		})
+	}
+	return
+}
+
+// run executes script and records it in one transaction
+func run(
+	dbEngine *xorm.Engine,
+	script string,
+	recordSQL string,
+	recordArgs ...interface{},
+) (err error) {
+	session := dbEngine.NewSession()
+	defer session.Close()
+
+	err = session.Begin()
+	if err != nil {
+		return
+	}
+	_, err = session.Exec(script)
+	if err != nil {
+		session.Rollback()
+		return
+	}
+	_, err = session.Exec(append([]interface{}{recordSQL}, recordArgs...)...)
+	if err != nil {
+		session.Rollback()
+		return
+	}
+	err = session.Commit()
+	return
+}
@@ -0,0 +1,128 @@
+package migrations
+
+import (
+	"errors"
+	"learning-web-chatboard3/common"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadEmbedded(t *testing.T) {
+	if len(all) != 2 {
+		t.Fatalf("migrations of %d drivers", len(all))
+	}
+	postgres, sqlite := all[common.DbDriverPostgres], all[common.DbDriverSQLite]
+	if len(postgres) == 0 || len(postgres) != Expected() {
+		t.Fatalf("%d migrations, %d expected", len(postgres), Expected())
+	}
+	for i := range postgres {
+		if postgres[i].Name != sqlite[i].Name {
+			t.Errorf(
+				"migration %d is %s on postgres, %s on sqlite3",
+				i+1,
+				postgres[i].Name,
+				sqlite[i].Name,
+			)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	for _, tc := range []struct {
+		name  string
+		files []string
+		err   string
+	}{
+		{"bad name", []string{"0001_initial.sql"}, "is not"},
+		{"no down", []string{"0001_initial.up.sql"}, "lacks up or down"},
+		{"no up", []string{"0001_initial.down.sql"}, "lacks up or down"},
+		{
+			"two names",
+			[]string{"0001_initial.up.sql", "0001_first.down.sql"},
+			"two names",
+		},
+		{
+			"missing version",
+			[]string{
+				"0001_initial.up.sql", "0001_initial.down.sql",
+				"0003_third.up.sql", "0003_third.down.sql",
+			},
+			"migration 2 is missing",
+		},
+	} {
+		fsys := fstest.MapFS{}
+		for _, name := range tc.files {
+			fsys["sql/test/"+name] = file
+		}
+		_, err := load(fsys, "test")
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dbEngine, err := common.OpenDb(&common.Configuration{
+		DbDriver: common.DbDriverSQLite,
+		DbName:   filepath.Join(t.TempDir(), "test.db"),
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	checkVersion := func(current int) {
+		t.Helper()
+		err := Check(dbEngine)
+		if current == Expected() {
+			if err != nil {
+				t.Errorf("at %d: %v", current, err)
+			}
+			return
+		}
+		var mismatch *VersionMismatchError
+		if !errors.As(err, &mismatch) ||
+			mismatch.Current != current ||
+			mismatch.Expected != Expected() {
+			t.Errorf("at %d: %v", current, err)
+		}
+	}
+
+	checkVersion(0)
+	applied, err := Up(dbEngine)
+	if err != nil || len(applied) != Expected() {
+		t.Fatalf("applied %d: %v", len(applied), err)
+	}
+	checkVersion(Expected())
+
+	// every down script runs, then every up again
+	for version := Expected(); version > 0; version-- {
+		reverted, err := Down(dbEngine)
+		if err != nil || reverted == nil || reverted.Version != version {
+			t.Fatalf("reverted %v: %v", reverted, err)
+		}
+		checkVersion(version - 1)
+	}
+	reverted, err := Down(dbEngine)
+	if err != nil || reverted != nil {
+		t.Errorf("reverted %v at 0: %v", reverted, err)
+	}
+	_, err = Up(dbEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// database migrated by a newer build
+	_, err = dbEngine.Exec(insertSQL, Expected()+1, "newer", "2026-01-01 00:00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(Expected() + 1)
+	_, err = Down(dbEngine)
+	if err == nil {
+		t.Error("reverted migration of newer build")
+	}
+}
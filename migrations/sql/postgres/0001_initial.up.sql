@@ -1,30 +1,26 @@
-DROP TABLE replies;
-DROP TABLE topics;
-DROP TABLE sessions;
-DROP TABLE logins;
-DROP TABLE users;
-
-CREATE TABLE users (
+-- schema of setup_db.sql, kept as is so that databases
+-- created by it are taken over without losing data
+CREATE TABLE IF NOT EXISTS users (
   id         SERIAL PRIMARY KEY,
   uu_id      VARCHAR(255) NOT NULL UNIQUE,
   name       VARCHAR(255) NOT NULL UNIQUE,
   email      VARCHAR(255) NOT NULL UNIQUE,
   password   TEXT NOT NULL,
   salt       VARCHAR(255) NOT NULL,
-  created_at TIMESTAMP NOT NULL   
+  created_at TIMESTAMP NOT NULL
 );
 
-CREATE TABLE logins (
+CREATE TABLE IF NOT EXISTS logins (
   id          SERIAL PRIMARY KEY,
   uu_id       VARCHAR(255) NOT NULL UNIQUE,
   user_name   VARCHAR(255),
   user_id     SERIAL REFERENCES users(id),
   state       TEXT,
   last_update TIMESTAMP NOT NULL,
-  created_at  TIMESTAMP NOT NULL   
+  created_at  TIMESTAMP NOT NULL
 );
 
-CREATE TABLE sessions (
+CREATE TABLE IF NOT EXISTS sessions (
   id           SERIAL PRIMARY KEY,
   uu_id        VARCHAR(255) NOT NULL UNIQUE,
   state        TEXT,
@@ -33,7 +29,7 @@ CREATE TABLE sessions (
   created_at   TIMESTAMP NOT NULL
 );
 
-CREATE TABLE topics (
+CREATE TABLE IF NOT EXISTS topics (
   id          SERIAL PRIMARY KEY,
   uu_id       VARCHAR(255) NOT NULL UNIQUE,
   topic       TEXT,
@@ -41,15 +37,15 @@ CREATE TABLE topics (
   owner       VARCHAR(255),
   user_id     SERIAL REFERENCES users(id),
   last_update TIMESTAMP NOT NULL,
-  created_at  TIMESTAMP NOT NULL       
+  created_at  TIMESTAMP NOT NULL
 );
 
-CREATE TABLE replies (
+CREATE TABLE IF NOT EXISTS replies (
   id          SERIAL PRIMARY KEY,
   uu_id       VARCHAR(255) NOT NULL UNIQUE,
   body        TEXT,
   contributor VARCHAR(255),
   user_id     SERIAL REFERENCES users(id),
-  topic_id   SERIAL REFERENCES topics(id),
-  created_at  TIMESTAMP NOT NULL  
+  topic_id    SERIAL REFERENCES topics(id),
+  created_at  TIMESTAMP NOT NULL
 );
@@ -0,0 +1,17 @@
+CREATE SEQUENCE replies_topic_id_seq OWNED BY replies.topic_id;
+ALTER TABLE replies ALTER COLUMN topic_id SET DEFAULT nextval('replies_topic_id_seq');
+CREATE SEQUENCE replies_user_id_seq OWNED BY replies.user_id;
+ALTER TABLE replies ALTER COLUMN user_id SET DEFAULT nextval('replies_user_id_seq');
+
+CREATE SEQUENCE topics_user_id_seq OWNED BY topics.user_id;
+ALTER TABLE topics ALTER COLUMN user_id SET DEFAULT nextval('topics_user_id_seq');
+CREATE SEQUENCE topics_num_replies_seq OWNED BY topics.num_replies;
+ALTER TABLE topics ALTER COLUMN num_replies SET DEFAULT nextval('topics_num_replies_seq');
+
+UPDATE sessions SET topic_id = 0 WHERE topic_id IS NULL;
+ALTER TABLE sessions ALTER COLUMN topic_id SET NOT NULL;
+CREATE SEQUENCE sessions_topic_id_seq OWNED BY sessions.topic_id;
+ALTER TABLE sessions ALTER COLUMN topic_id SET DEFAULT nextval('sessions_topic_id_seq');
+
+CREATE SEQUENCE logins_user_id_seq OWNED BY logins.user_id;
+ALTER TABLE logins ALTER COLUMN user_id SET DEFAULT nextval('logins_user_id_seq');
@@ -0,0 +1,18 @@
+-- counters and foreign keys were SERIAL,
+-- which filled them from sequences when not given
+ALTER TABLE logins ALTER COLUMN user_id DROP DEFAULT;
+DROP SEQUENCE logins_user_id_seq;
+
+ALTER TABLE sessions ALTER COLUMN topic_id DROP DEFAULT;
+ALTER TABLE sessions ALTER COLUMN topic_id DROP NOT NULL;
+DROP SEQUENCE sessions_topic_id_seq;
+
+ALTER TABLE topics ALTER COLUMN num_replies SET DEFAULT 0;
+DROP SEQUENCE topics_num_replies_seq;
+ALTER TABLE topics ALTER COLUMN user_id DROP DEFAULT;
+DROP SEQUENCE topics_user_id_seq;
+
+ALTER TABLE replies ALTER COLUMN user_id DROP DEFAULT;
+DROP SEQUENCE replies_user_id_seq;
+ALTER TABLE replies ALTER COLUMN topic_id DROP DEFAULT;
+DROP SEQUENCE replies_topic_id_seq;
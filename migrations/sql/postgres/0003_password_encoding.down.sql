@@ -0,0 +1,8 @@
+-- users whose password was upgraded to argon2id
+-- cannot login with the previous version
+ALTER TABLE users ADD COLUMN salt VARCHAR(255) NOT NULL DEFAULT '';
+UPDATE users SET
+  salt = split_part(password, '$', 3),
+  password = split_part(password, '$', 4)
+  WHERE password LIKE '$sha256$%';
+ALTER TABLE users ALTER COLUMN salt DROP DEFAULT;
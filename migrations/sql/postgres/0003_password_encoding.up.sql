@@ -0,0 +1,5 @@
+-- salted sha256 passwords carry their salt as $sha256$<salt>$<hash>,
+-- so that salt is no longer needed. they are upgraded on login.
+UPDATE users SET password = '$sha256$' || salt || '$' || password
+  WHERE password NOT LIKE '$%';
+ALTER TABLE users DROP COLUMN salt;
@@ -0,0 +1,2 @@
+ALTER TABLE logins ADD COLUMN state TEXT;
+ALTER TABLE sessions ADD COLUMN state TEXT;
@@ -0,0 +1,3 @@
+-- states of forms are no longer stored, csrf tokens are stateless
+ALTER TABLE logins DROP COLUMN state;
+ALTER TABLE sessions DROP COLUMN state;
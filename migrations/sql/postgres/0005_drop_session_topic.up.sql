@@ -0,0 +1,3 @@
+-- replies name their topic in the form, not in the session
+ALTER TABLE sessions DROP COLUMN topic_id;
+ALTER TABLE sessions DROP COLUMN topic_uu_id;
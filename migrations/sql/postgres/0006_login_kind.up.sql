@@ -0,0 +1,2 @@
+-- browser and api logins end only logins of their own kind
+ALTER TABLE logins ADD COLUMN kind VARCHAR(255) NOT NULL DEFAULT 'browser';
@@ -0,0 +1,5 @@
+DROP TABLE replies;
+DROP TABLE topics;
+DROP TABLE sessions;
+DROP TABLE logins;
+DROP TABLE users;
@@ -0,0 +1,49 @@
+CREATE TABLE users (
+  id         INTEGER PRIMARY KEY AUTOINCREMENT,
+  uu_id      VARCHAR(255) NOT NULL UNIQUE,
+  name       VARCHAR(255) NOT NULL UNIQUE,
+  email      VARCHAR(255) NOT NULL UNIQUE,
+  password   TEXT NOT NULL,
+  salt       VARCHAR(255) NOT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE TABLE logins (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  uu_id       VARCHAR(255) NOT NULL UNIQUE,
+  user_name   VARCHAR(255),
+  user_id     INTEGER REFERENCES users(id),
+  state       TEXT,
+  last_update DATETIME NOT NULL,
+  created_at  DATETIME NOT NULL
+);
+
+CREATE TABLE sessions (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  uu_id        VARCHAR(255) NOT NULL UNIQUE,
+  state        TEXT,
+  topic_uu_id  TEXT,
+  topic_id     INTEGER,
+  created_at   DATETIME NOT NULL
+);
+
+CREATE TABLE topics (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  uu_id       VARCHAR(255) NOT NULL UNIQUE,
+  topic       TEXT,
+  num_replies INTEGER NOT NULL DEFAULT 0,
+  owner       VARCHAR(255),
+  user_id     INTEGER REFERENCES users(id),
+  last_update DATETIME NOT NULL,
+  created_at  DATETIME NOT NULL
+);
+
+CREATE TABLE replies (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  uu_id       VARCHAR(255) NOT NULL UNIQUE,
+  body        TEXT,
+  contributor VARCHAR(255),
+  user_id     INTEGER REFERENCES users(id),
+  topic_id    INTEGER REFERENCES topics(id),
+  created_at  DATETIME NOT NULL
+);
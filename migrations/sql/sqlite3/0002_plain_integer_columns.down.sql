@@ -0,0 +1,3 @@
+-- columns were created as plain integers from the start,
+-- kept so that versions are the same as postgres
+SELECT 1;
@@ -0,0 +1,7 @@
+-- users whose password was upgraded to argon2id
+-- cannot login with the previous version
+ALTER TABLE users ADD COLUMN salt VARCHAR(255) NOT NULL DEFAULT '';
+UPDATE users SET
+  salt = substr(password, 9, instr(substr(password, 9), '$') - 1),
+  password = substr(password, 9 + instr(substr(password, 9), '$'))
+  WHERE password LIKE '$sha256$%';
@@ -0,0 +1,2 @@
+ALTER TABLE sessions ADD COLUMN topic_uu_id TEXT;
+ALTER TABLE sessions ADD COLUMN topic_id INTEGER;
@@ -0,0 +1,103 @@
+package rabbitrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgPack = "application/msgpack"
+)
+
+// Codec encodes envelope and its body.
+// content type of the message tells which codec to use,
+// so services with different codecs can talk to each other
+// as long as the receiver knows the codec.
+type Codec interface {
+	ContentType() string
+	Marshal(dataPtr interface{}) ([]byte, error)
+	Unmarshal(bin []byte, dataPtr interface{}) error
+}
+
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(MsgPackCodec)
+}
+
+// RegisterCodec makes codec available for incoming messages
+func RegisterCodec(codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecFor returns codec for contentType.
+// empty content type is JSON, which was the only format before.
+func CodecFor(contentType string) (codec Codec, errorCodecNotFound *RabbitRPCError) {
+	if len(contentType) == 0 {
+		codec = JSONCodec
+		return
+	}
+
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	codec, ok := codecs[contentType]
+	if !ok {
+		errorCodecNotFound = &RabbitRPCError{
+			What: fmt.Sprintf("content type %q is not supported", contentType),
+		}
+	}
+	return
+}
+
+// json
+
+type jsonCodec struct{}
+
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(dataPtr interface{}) ([]byte, error) {
+	return json.Marshal(dataPtr)
+}
+
+func (jsonCodec) Unmarshal(bin []byte, dataPtr interface{}) error {
+	return json.Unmarshal(bin, dataPtr)
+}
+
+// message pack, json tags are reused for field names
+
+type msgpackCodec struct{}
+
+var MsgPackCodec Codec = msgpackCodec{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (msgpackCodec) Marshal(dataPtr interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(dataPtr)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(bin []byte, dataPtr interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(bin))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(dataPtr)
+}
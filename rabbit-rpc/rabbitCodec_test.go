@@ -0,0 +1,112 @@
+package rabbitrpc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecSample struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	Tags      []string  `json:"tags"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	sample := codecSample{
+		Id:        1,
+		Name:      "name",
+		Tags:      []string{"a", "b"},
+		CreatedAt: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgPack} {
+		t.Run(contentType, func(t *testing.T) {
+			codec, e := CodecFor(contentType)
+			if e != nil {
+				t.Fatal(e)
+			}
+			bin, e := MakeBinWith(codec, MethodCodePOST, StatusOK, "fn", "codecSample", &sample)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			envelop, e := FromRaws(&Raws{Body: bin, ContentType: contentType})
+			if e != nil {
+				t.Fatal(e)
+			}
+			if envelop.FunctionToCall != "fn" || envelop.DataTypeName != "codecSample" {
+				t.Errorf("envelope is %+v", envelop)
+			}
+			var got codecSample
+			e = envelop.Extract(&got)
+			if e != nil {
+				t.Fatal(e)
+			}
+			// msgpack decodes time in local time zone
+			if !got.CreatedAt.Equal(sample.CreatedAt) {
+				t.Errorf("created at %v, want %v", got.CreatedAt, sample.CreatedAt)
+			}
+			got.CreatedAt = sample.CreatedAt
+			if !reflect.DeepEqual(got, sample) {
+				t.Errorf("got %+v, want %+v", got, sample)
+			}
+		})
+	}
+}
+
+func TestJSONBodyIsNested(t *testing.T) {
+	sample := codecSample{Id: 1, Name: "name"}
+	bin, e := MakeBin(MethodCodePOST, StatusOK, "fn", "codecSample", &sample)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var wire struct {
+		Body map[string]interface{} `json:"body"`
+	}
+	err := json.Unmarshal(bin, &wire)
+	if err != nil {
+		t.Fatalf("body is not an object in %s: %v", bin, err)
+	}
+	if wire.Body["name"] != "name" {
+		t.Errorf("body is %v", wire.Body)
+	}
+}
+
+func TestJSONBodyOfOlderServices(t *testing.T) {
+	// body was []byte, so base64 encoded
+	body, err := json.Marshal(codecSample{Id: 1, Name: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := json.Marshal(struct {
+		FunctionToCall string `json:"function_to_call"`
+		DataTypeName   string `json:"type_name"`
+		Body           []byte `json:"body"`
+	}{"fn", "codecSample", body})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelop, e := FromBin(bin)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var got codecSample
+	e = envelop.Extract(&got)
+	if e != nil || got.Id != 1 || got.Name != "name" {
+		t.Errorf("got %+v, %v", got, e)
+	}
+}
+
+func TestCodecForEmptyIsJSON(t *testing.T) {
+	codec, e := CodecFor("")
+	if e != nil || codec.ContentType() != ContentTypeJSON {
+		t.Errorf("got %v, %v", codec, e)
+	}
+	_, e = CodecFor("text/plain")
+	if e == nil {
+		t.Error("unknown content type has codec")
+	}
+}
@@ -0,0 +1,301 @@
+package rabbitrpc
+
+import (
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// dead letters
+
+const (
+	DefaultMaxRetries = 3
+
+	HeaderRetryCount         = "x-retry-count"
+	HeaderError              = "x-error"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+)
+
+func DeadLetterExchangeName(exchangeName string) string {
+	return fmt.Sprint(exchangeName, ".dlx")
+}
+
+func QuarantineQueueName(queueName string) string {
+	return fmt.Sprint(queueName, ".quarantine")
+}
+
+// dead letter exchange is direct and
+// the quarantine queue is bound with its own name
+func (rabbit *RabbitClient) declareQuarantine(ch *amqp.Channel) error {
+	dlx := DeadLetterExchangeName(rabbit.ExchangeName)
+	quarantine := QuarantineQueueName(rabbit.SubscribeQueueName)
+
+	_, err := ch.QueueDeclare(
+		quarantine,
+		rabbit.Durable,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot declare quarantine: %q %v", quarantine, err)
+	}
+
+	err = ch.QueueBind(
+		quarantine,
+		quarantine,
+		dlx,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot bind quarantine: %q %v", quarantine, err)
+	}
+	return nil
+}
+
+// RetryCount is how many times raws has been retried
+func (raws *Raws) RetryCount() int {
+	return headerInt(raws.Headers[HeaderRetryCount])
+}
+
+func headerInt(val interface{}) int {
+	switch n := val.(type) {
+	case int:
+		return n
+	case int8:
+		return int(n)
+	case int16:
+		return int(n)
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	default:
+		return 0
+	}
+}
+
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(headers)+3)
+	for key, val := range headers {
+		copied[key] = val
+	}
+	return copied
+}
+
+// Retry publishes the request again to this server's queue,
+// or quarantines it when MaxRetries is exceeded.
+// retried is true when the request is tried again.
+// when it cannot be published, it is requeued to the broker
+// and err is returned.
+func (rabbit *RabbitClient) Retry(raws Raws, cause error) (retried bool, err error) {
+	maxRetries := rabbit.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	count := raws.RetryCount()
+	if count >= maxRetries {
+		err = rabbit.DeadLetter(raws, cause)
+		return
+	}
+
+	retry := raws
+	retry.delivery = nil
+	retry.Exchange = rabbit.ExchangeName
+	retry.RoutingKey = rabbit.SubscribeRoutingKey
+	retry.Headers = copyHeaders(raws.Headers)
+	retry.Headers[HeaderRetryCount] = int32(count + 1)
+	retry.Headers[HeaderError] = cause.Error()
+
+	err = rabbit.Send(retry)
+	if err != nil {
+		raws.Nack(true)
+		return
+	}
+	raws.Ack()
+	retried = true
+	return
+}
+
+// DeadLetter sends raws to the quarantine queue of this server,
+// keeping the original body and the error.
+// when it cannot be published, it is requeued to the broker
+// and err is returned.
+func (rabbit *RabbitClient) DeadLetter(raws Raws, cause error) (err error) {
+	rabbitLogger.With(RawsFields(&raws)...).Warning(
+		"quarantine",
+		"error", cause,
+	)
+
+	dead := raws
+	dead.delivery = nil
+	dead.Exchange = DeadLetterExchangeName(rabbit.ExchangeName)
+	dead.RoutingKey = QuarantineQueueName(rabbit.SubscribeQueueName)
+	dead.Headers = copyHeaders(raws.Headers)
+	dead.Headers[HeaderError] = cause.Error()
+	dead.Headers[HeaderOriginalExchange] = rabbit.ExchangeName
+	dead.Headers[HeaderOriginalRoutingKey] = rabbit.SubscribeRoutingKey
+
+	err = rabbit.Send(dead)
+	if err != nil {
+		raws.Nack(true)
+		return
+	}
+	raws.Ack()
+	return
+}
+
+// inspection of quarantine, used by chatboard deadletters
+
+type DeadLetter struct {
+	CorrelationId      string
+	ContentType        string
+	ReplyTo            string
+	OriginalExchange   string
+	OriginalRoutingKey string
+	Error              string
+	RetryCount         int
+	Body               []byte
+}
+
+func withChannel(rabbitURL string, fn func(ch *amqp.Channel) error) error {
+	conn, err := amqp.Dial(rabbitURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func toDeadLetter(deli amqp.Delivery) DeadLetter {
+	errMsg, _ := deli.Headers[HeaderError].(string)
+	exchange, _ := deli.Headers[HeaderOriginalExchange].(string)
+	routingKey, _ := deli.Headers[HeaderOriginalRoutingKey].(string)
+
+	// dead lettered by broker, not by Retry or DeadLetter
+	deaths, _ := deli.Headers["x-death"].([]interface{})
+	if len(exchange) == 0 && len(deaths) > 0 {
+		death, _ := deaths[0].(amqp.Table)
+		exchange, _ = death["exchange"].(string)
+		keys, _ := death["routing-keys"].([]interface{})
+		if len(keys) > 0 {
+			routingKey, _ = keys[0].(string)
+		}
+		reason, _ := death["reason"].(string)
+		errMsg = fmt.Sprint("rejected by broker: ", reason)
+	}
+
+	return DeadLetter{
+		CorrelationId:      deli.CorrelationId,
+		ContentType:        deli.ContentType,
+		ReplyTo:            deli.ReplyTo,
+		OriginalExchange:   exchange,
+		OriginalRoutingKey: routingKey,
+		Error:              errMsg,
+		RetryCount:         headerInt(deli.Headers[HeaderRetryCount]),
+		Body:               deli.Body,
+	}
+}
+
+// countOf is number of messages ready in queue.
+// loops over quarantine stop there,
+// so that messages coming back meanwhile are not read forever.
+func countOf(ch *amqp.Channel, queue string) (int, error) {
+	q, err := ch.QueueInspect(queue)
+	if err != nil {
+		return 0, err
+	}
+	return q.Messages, nil
+}
+
+// ListDeadLetters reads messages in quarantine without removing them
+func ListDeadLetters(rabbitURL, quarantine string) (letters []DeadLetter, err error) {
+	err = withChannel(rabbitURL, func(ch *amqp.Channel) error {
+		count, e := countOf(ch, quarantine)
+		if e != nil {
+			return e
+		}
+		for i := 0; i < count; i++ {
+			deli, ok, e := ch.Get(quarantine, false)
+			if e != nil {
+				return e
+			}
+			if !ok {
+				break
+			}
+			letters = append(letters, toDeadLetter(deli))
+		}
+		// closing channel puts unacked messages back
+		return nil
+	})
+	return
+}
+
+// ReplayDeadLetters publishes quarantined messages to where
+// they were sent originally, with retry count cleared
+func ReplayDeadLetters(rabbitURL, quarantine string) (replayed int, err error) {
+	err = withChannel(rabbitURL, func(ch *amqp.Channel) error {
+		count, e := countOf(ch, quarantine)
+		if e != nil {
+			return e
+		}
+		for i := 0; i < count; i++ {
+			deli, ok, e := ch.Get(quarantine, false)
+			if e != nil {
+				return e
+			}
+			if !ok {
+				return nil
+			}
+
+			letter := toDeadLetter(deli)
+			headers := copyHeaders(deli.Headers)
+			delete(headers, HeaderRetryCount)
+			delete(headers, HeaderError)
+
+			e = ch.Publish(
+				letter.OriginalExchange,
+				letter.OriginalRoutingKey,
+				false,
+				false,
+				amqp.Publishing{
+					ContentType:   deli.ContentType,
+					DeliveryMode:  deli.DeliveryMode,
+					CorrelationId: deli.CorrelationId,
+					ReplyTo:       deli.ReplyTo,
+					Headers:       amqp.Table(headers),
+					Body:          deli.Body,
+				},
+			)
+			if e != nil {
+				deli.Nack(false, true)
+				return e
+			}
+			e = deli.Ack(false)
+			if e != nil {
+				return e
+			}
+			replayed++
+		}
+		return nil
+	})
+	return
+}
+
+// PurgeDeadLetters removes every message in quarantine
+func PurgeDeadLetters(rabbitURL, quarantine string) (purged int, err error) {
+	err = withChannel(rabbitURL, func(ch *amqp.Channel) (e error) {
+		purged, e = ch.QueuePurge(quarantine, false)
+		return
+	})
+	return
+}
@@ -0,0 +1,70 @@
+package rabbitrpc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics of rpc, exposed by metrics.Handler of each process
+
+var (
+	callsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_calls_total",
+		Help: "Requests published by clients.",
+	}, []string{"function"})
+	callDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "rabbitrpc_call_duration_seconds",
+		Help: "Round trip time from publishing a request to receiving its response.",
+	}, []string{"function"})
+	callsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_calls_expired_total",
+		Help: "Requests whose response did not arrive before the deadline.",
+	}, []string{"function"})
+	pendingCallsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitrpc_pending_calls",
+		Help: "Requests waiting for response.",
+	})
+	unknownResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitrpc_unknown_responses_total",
+		Help: "Responses to unknown, expired or already resolved requests.",
+	})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "rabbitrpc_handler_duration_seconds",
+		Help: "Time spent by server handlers.",
+	}, []string{"function"})
+	handlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_handler_errors_total",
+		Help: "Errors returned by server handlers by error code.",
+	}, []string{"function", "code"})
+
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_published_messages_total",
+		Help: "Messages handed to the broker.",
+	}, []string{"exchange"})
+	publishNacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_publish_nacks_total",
+		Help: "Messages nacked by the broker in publisher confirms.",
+	}, []string{"exchange"})
+	publishPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rabbitrpc_publish_pending",
+		Help: "Messages queued in the publisher, not yet confirmed by the broker.",
+	}, []string{"exchange"})
+	dialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_dial_failures_total",
+		Help: "Failed attempts to connect to the broker.",
+	}, []string{"exchange"})
+	reconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitrpc_reconnects_total",
+		Help: "Connections established again after the first one was lost.",
+	}, []string{"exchange"})
+
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rabbitrpc_queue_depth",
+		Help: "Messages ready in queues by name, by exchange/key in process.",
+	}, []string{"queue"})
+	droppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitrpc_dropped_messages_total",
+		Help: "Messages dropped in process since nobody subscribed their full queue.",
+	})
+)
@@ -0,0 +1,138 @@
+package rabbitrpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pending calls of a client, keyed by correlation id.
+// safe for concurrent use, replacement of CallbackPool.
+
+type pendingCall struct {
+	callback       func(raws Raws)
+	functionToCall string
+	started        time.Time
+	deadline       time.Time
+}
+
+type PendingStats struct {
+	Pending  int
+	Resolved uint64
+	Expired  uint64
+	Unknown  uint64
+}
+
+type PendingCalls struct {
+	mutex sync.Mutex
+	calls map[string]pendingCall
+	stats PendingStats
+}
+
+func NewPendingCalls() *PendingCalls {
+	return &PendingCalls{
+		calls: make(map[string]pendingCall),
+	}
+}
+
+// Add registers callback for corrId.
+// the call is swept when it is still pending after deadline.
+// functionToCall labels the metrics of the call.
+func (pending *PendingCalls) Add(
+	corrId string,
+	functionToCall string,
+	deadline time.Time,
+	callback func(raws Raws),
+) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	pending.calls[corrId] = pendingCall{
+		callback:       callback,
+		functionToCall: functionToCall,
+		started:        time.Now(),
+		deadline:       deadline,
+	}
+	callsTotal.WithLabelValues(functionToCall).Inc()
+	pendingCallsGauge.Inc()
+}
+
+// Resolve removes the call for raws and returns its callback.
+// ok is false for unknown, expired or already resolved response.
+func (pending *PendingCalls) Resolve(raws Raws) (callback func(raws Raws), ok bool) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	call, ok := pending.calls[raws.CorrelationId]
+	if !ok {
+		pending.stats.Unknown++
+		unknownResponses.Inc()
+		return
+	}
+	delete(pending.calls, raws.CorrelationId)
+	pending.stats.Resolved++
+	pendingCallsGauge.Dec()
+	callDuration.WithLabelValues(call.functionToCall).Observe(
+		time.Since(call.started).Seconds(),
+	)
+	callback = call.callback
+	return
+}
+
+// Remove forgets the call abandoned by caller
+func (pending *PendingCalls) Remove(corrId string) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	if _, ok := pending.calls[corrId]; ok {
+		delete(pending.calls, corrId)
+		pendingCallsGauge.Dec()
+	}
+}
+
+// Sweep removes calls whose deadline is before now
+func (pending *PendingCalls) Sweep(now time.Time) (swept int) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	for corrId, call := range pending.calls {
+		if call.deadline.Before(now) {
+			delete(pending.calls, corrId)
+			callsExpired.WithLabelValues(call.functionToCall).Inc()
+			swept++
+		}
+	}
+	pending.stats.Expired += uint64(swept)
+	pendingCallsGauge.Add(-float64(swept))
+	return
+}
+
+// RunSweeper sweeps every interval until ctx is done
+func (pending *PendingCalls) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			swept := pending.Sweep(now)
+			if swept > 0 {
+				rabbitLogger.Warning("swept expired calls", "count", swept)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (pending *PendingCalls) Len() int {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	return len(pending.calls)
+}
+
+func (pending *PendingCalls) Stats() (stats PendingStats) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	stats = pending.stats
+	stats.Pending = len(pending.calls)
+	return
+}
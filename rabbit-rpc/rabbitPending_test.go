@@ -0,0 +1,55 @@
+package rabbitrpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingCalls(t *testing.T) {
+	pending := NewPendingCalls()
+	now := time.Now()
+	called := ""
+	for _, corrId := range []string{"resolved", "removed", "expired", "waiting"} {
+		corrId := corrId
+		deadline := now.Add(time.Minute)
+		if corrId == "expired" {
+			deadline = now.Add(-time.Second)
+		}
+		pending.Add(corrId, "test", deadline, func(Raws) { called = corrId })
+	}
+
+	callback, ok := pending.Resolve(Raws{CorrelationId: "resolved"})
+	if !ok {
+		t.Fatal("resolved call is not pending")
+	}
+	callback(Raws{})
+	if called != "resolved" {
+		t.Errorf("called back %q", called)
+	}
+	_, ok = pending.Resolve(Raws{CorrelationId: "resolved"})
+	if ok {
+		t.Error("resolved twice")
+	}
+	_, ok = pending.Resolve(Raws{CorrelationId: "unknown"})
+	if ok {
+		t.Error("resolved unknown call")
+	}
+	pending.Remove("removed")
+
+	swept := pending.Sweep(now)
+	if swept != 1 {
+		t.Errorf("swept %d", swept)
+	}
+	_, ok = pending.Resolve(Raws{CorrelationId: "expired"})
+	if ok {
+		t.Error("resolved swept call")
+	}
+
+	want := PendingStats{Pending: 1, Resolved: 1, Expired: 1, Unknown: 3}
+	if stats := pending.Stats(); stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	if pending.Len() != 1 {
+		t.Errorf("%d pending", pending.Len())
+	}
+}
@@ -3,9 +3,13 @@ package rabbitrpc
 import (
 	"context"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"learning-web-chatboard3/logging"
+
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -15,13 +19,78 @@ const (
 	ExchangeKindFanout = "fanout"
 	ExchangeKindDirect = "direct"
 	ExchangeKindTopic  = "topic"
+
+	DefaultPrefetch = 1
+
+	DefaultMinRedialInterval = time.Millisecond * 500
+	DefaultMaxRedialInterval = time.Second * 30
+
+	// servers look into their queue and quarantine this often
+	queueDepthInterval = time.Second * 15
 )
 
-var rabbitLogger *log.Logger
+var rabbitLogger = logging.Default().With("component", "rabbitrpc")
+
+// SetLogger replaces the logger of this package,
+// call it before creating clients
+func SetLogger(logger *logging.Logger) {
+	rabbitLogger = logger.With("component", "rabbitrpc")
+}
 
 type Raws struct {
 	Body          []byte
 	CorrelationId string
+	ContentType   string
+
+	// routing key the receiver should answer to
+	ReplyTo string
+	// override ExchangeName and PublishRoutingKey when not empty
+	Exchange   string
+	RoutingKey string
+
+	Headers map[string]interface{}
+
+	// set when the message has to be acked manually
+	delivery *delivery
+}
+
+type acknowledger interface {
+	Ack(multiple bool) error
+	Nack(multiple, requeue bool) error
+}
+
+// acked only once, whoever comes first
+type delivery struct {
+	acknowledger
+	once sync.Once
+	// called once acked or nacked
+	done func()
+}
+
+// Ack tells the broker that the message is handled.
+// does nothing for messages acked on delivery or acked already.
+func (raws *Raws) Ack() (err error) {
+	if raws.delivery == nil {
+		return
+	}
+	raws.delivery.once.Do(func() {
+		err = raws.delivery.Ack(false)
+		raws.delivery.done()
+	})
+	return
+}
+
+// Nack tells the broker that the message could not be handled.
+// the message is dead lettered unless requeued.
+func (raws *Raws) Nack(requeue bool) (err error) {
+	if raws.delivery == nil {
+		return
+	}
+	raws.delivery.once.Do(func() {
+		err = raws.delivery.Nack(false, requeue)
+		raws.delivery.done()
+	})
+	return
 }
 
 type session struct {
@@ -36,6 +105,16 @@ func (sess *session) close() error {
 	return sess.Connection.Close()
 }
 
+type Options struct {
+	// durable exchange and server queue, persistent messages.
+	// all clients and servers on an exchange must agree on this.
+	Durable bool
+	// number of unacked requests a server takes at once
+	Prefetch int
+	// times a failed request is tried again before quarantined
+	MaxRetries int
+}
+
 type RabbitHandle struct {
 	CTX  context.Context
 	Done context.CancelFunc
@@ -45,6 +124,7 @@ type RabbitHandle struct {
 type RabbitClient struct {
 	Publisher  *RabbitHandle
 	Subscriber *RabbitHandle
+	Transport  Transport
 
 	ContentType         string
 	RabbitURL           string
@@ -54,13 +134,28 @@ type RabbitClient struct {
 	ExchangeKind        string
 	PublishRoutingKey   string
 	SubscribeRoutingKey string
-}
 
-func openLogger() {
-	if rabbitLogger == nil {
-		rabbitLogger = log.Default()
-		rabbitLogger.SetPrefix("[RabbitMQ RPC] ")
-	}
+	// backoff of redial grows from Min to Max,
+	// MaxRedialAttempts <= 0 means retrying forever
+	MinRedialInterval time.Duration
+	MaxRedialInterval time.Duration
+	MaxRedialAttempts int
+
+	Options
+	// servers share the subscribe queue with other instances
+	// and ack requests only after they are handled
+	IsServer bool
+
+	stateMutex     sync.Mutex
+	state          ConnectionState
+	stateObservers []func(state ConnectionState)
+
+	// closed by StopConsuming
+	consumeCTX  context.Context
+	stopConsume context.CancelFunc
+	// counted atomically, see Shutdown
+	inflight    int64
+	unpublished int64
 }
 
 func NewRPCClient(
@@ -71,183 +166,299 @@ func NewRPCClient(
 	exchangeKind string,
 	publishKey string,
 	subscribeKey string,
+	options Options,
 	callback func(raws Raws),
 ) (client *RabbitClient) {
-	client = &RabbitClient{
-		ContentType:         "application/json",
-		RabbitURL:           rabbitURL,
-		PublishQueueName:    publishQueueName,
-		SubscribeQueueName:  subscribeQueueName,
-		ExchangeName:        exchangeName,
-		ExchangeKind:        exchangeKind,
-		PublishRoutingKey:   publishKey,
-		SubscribeRoutingKey: subscribeKey,
-	}
-
-	client.Publisher = &RabbitHandle{}
-	client.Publisher.CTX, client.Publisher.Done = context.WithCancel(
-		context.Background(),
+	client = newRabbitClient(
+		publishQueueName,
+		uniqueName(subscribeQueueName),
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		uniqueName(subscribeKey),
+		options,
+		false,
 	)
-	client.Publisher.Ch = make(chan Raws)
+	client.RabbitURL = rabbitURL
+	client.start(AMQPTransport, callback)
+	return
+}
 
-	client.Subscriber = &RabbitHandle{}
-	client.Subscriber.CTX, client.Subscriber.Done = context.WithCancel(
-		context.Background(),
+func NewRPCServer(
+	rabbitURL string,
+	publishQueueName string,
+	subscribeQueueName string,
+	exchangeName string,
+	exchangeKind string,
+	publishKey string,
+	subscribeKey string,
+	options Options,
+	callback func(raws Raws),
+) (server *RabbitClient) {
+	server = newRabbitClient(
+		publishQueueName,
+		subscribeQueueName,
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		subscribeKey,
+		options,
+		true,
 	)
+	server.RabbitURL = rabbitURL
+	server.start(AMQPTransport, callback)
+	return
+}
 
-	go func() {
-		client.publisherRoutine(
-			redial(
-				client.Publisher.CTX,
-				client.RabbitURL,
-				client.ExchangeName,
-				client.ExchangeKind,
-			),
-			client.Publisher.Ch,
-		)
-	}()
-
-	go func() {
-		client.subscriberRoutine(
-			redial(
-				client.Subscriber.CTX,
-				client.RabbitURL,
-				client.ExchangeName,
-				client.ExchangeKind,
-			),
-			setCallback(callback),
-		)
-	}()
-
-	openLogger()
+// same as NewRPCClient, but messages go through transport
+func NewRPCClientWithTransport(
+	transport Transport,
+	publishQueueName string,
+	subscribeQueueName string,
+	exchangeName string,
+	exchangeKind string,
+	publishKey string,
+	subscribeKey string,
+	options Options,
+	callback func(raws Raws),
+) (client *RabbitClient) {
+	client = newRabbitClient(
+		publishQueueName,
+		uniqueName(subscribeQueueName),
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		uniqueName(subscribeKey),
+		options,
+		false,
+	)
+	client.start(transport, callback)
 	return
 }
 
-func NewRPCServer(
-	rabbitURL string,
+// same as NewRPCServer, but messages go through transport
+func NewRPCServerWithTransport(
+	transport Transport,
 	publishQueueName string,
 	subscribeQueueName string,
 	exchangeName string,
 	exchangeKind string,
 	publishKey string,
 	subscribeKey string,
+	options Options,
 	callback func(raws Raws),
 ) (server *RabbitClient) {
-	server = &RabbitClient{
-		ContentType:         "application/json",
-		RabbitURL:           rabbitURL,
+	server = newRabbitClient(
+		publishQueueName,
+		subscribeQueueName,
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		subscribeKey,
+		options,
+		true,
+	)
+	server.start(transport, callback)
+	return
+}
+
+func newRabbitClient(
+	publishQueueName string,
+	subscribeQueueName string,
+	exchangeName string,
+	exchangeKind string,
+	publishKey string,
+	subscribeKey string,
+	options Options,
+	isServer bool,
+) (rabbit *RabbitClient) {
+	rabbit = &RabbitClient{
+		ContentType:         ContentTypeJSON,
+		RabbitURL:           DefaultRabbitURL,
 		PublishQueueName:    publishQueueName,
 		SubscribeQueueName:  subscribeQueueName,
 		ExchangeName:        exchangeName,
 		ExchangeKind:        exchangeKind,
 		PublishRoutingKey:   publishKey,
 		SubscribeRoutingKey: subscribeKey,
+		MinRedialInterval:   DefaultMinRedialInterval,
+		MaxRedialInterval:   DefaultMaxRedialInterval,
+		Options:             options,
+		IsServer:            isServer,
+	}
+	if rabbit.Prefetch <= 0 {
+		rabbit.Prefetch = DefaultPrefetch
 	}
 
-	server.Publisher = &RabbitHandle{}
-	server.Publisher.CTX, server.Publisher.Done = context.WithCancel(
+	rabbit.Publisher = &RabbitHandle{}
+	rabbit.Publisher.CTX, rabbit.Publisher.Done = context.WithCancel(
 		context.Background(),
 	)
-	server.Publisher.Ch = make(chan Raws)
+	rabbit.Publisher.Ch = make(chan Raws)
 
-	server.Subscriber = &RabbitHandle{}
-	server.Subscriber.CTX, server.Subscriber.Done = context.WithCancel(
+	rabbit.Subscriber = &RabbitHandle{}
+	rabbit.Subscriber.CTX, rabbit.Subscriber.Done = context.WithCancel(
 		context.Background(),
 	)
+	rabbit.consumeCTX, rabbit.stopConsume = context.WithCancel(
+		rabbit.Subscriber.CTX,
+	)
+	return
+}
 
-	go func() {
-		server.publisherRoutine(
-			redial(
-				server.Publisher.CTX,
-				server.RabbitURL,
-				server.ExchangeName,
-				server.ExchangeKind,
-			),
-			server.Publisher.Ch,
-		)
-	}()
+// clients subscribe to their own queue and key,
+// so that several clients can wait for responses at the same time.
+// servers answer to Raws.ReplyTo of the request.
+func uniqueName(name string) string {
+	return fmt.Sprintf("%s.%s", name, uuid.New().String())
+}
 
-	go func() {
-		server.subscriberRoutine(
-			redial(
-				server.Subscriber.CTX,
-				server.RabbitURL,
-				server.ExchangeName,
-				server.ExchangeKind,
-			),
-			setCallback(callback),
-		)
-	}()
+func (rabbit *RabbitClient) start(transport Transport, callback func(raws Raws)) {
+	rabbit.Transport = transport
+	if binder, ok := transport.(binder); ok {
+		binder.bind(rabbit)
+	}
+	go transport.RunPublisher(rabbit, rabbit.Publisher.Ch)
+	go transport.RunSubscriber(rabbit, setCallback(callback))
+}
 
-	openLogger()
-	return
+// Send queues raws to the publisher.
+// fails with ErrorPublisherDone instead of blocking forever
+// once the publisher has stopped, by Shutdown or giving up dialing.
+func (rabbit *RabbitClient) Send(raws Raws) error {
+	select {
+	case rabbit.Publisher.Ch <- raws:
+		return nil
+	case <-rabbit.Publisher.CTX.Done():
+		return ErrorPublisherDone
+	}
 }
 
+// random part makes the id unique
+// even if two calls are made at the same time
 func (rabbit *RabbitClient) GenerateCorrelationID() string {
 	return fmt.Sprintf(
-		"%s/at%d/%s.to.%s",
+		"%s/%s.to.%s/%s",
 		rabbit.ExchangeName,
-		time.Now().UnixMicro(),
 		rabbit.SubscribeRoutingKey,
 		rabbit.PublishRoutingKey,
+		uuid.New().String(),
 	)
 }
 
-func redial(
-	ctx context.Context,
-	url string,
-	exchangeName string,
-	exchangeKind string,
+// amqp transport
+
+type amqpTransport struct {
+	rabbitURL string
+}
+
+// AMQPTransport talks to RabbitMQ at RabbitClient.RabbitURL
+var AMQPTransport Transport = amqpTransport{}
+
+// NewAMQPTransport talks to RabbitMQ at rabbitURL,
+// instead of RabbitClient.RabbitURL
+func NewAMQPTransport(rabbitURL string) Transport {
+	return amqpTransport{rabbitURL: rabbitURL}
+}
+
+func (transport amqpTransport) urlOf(rabbit *RabbitClient) string {
+	if len(transport.rabbitURL) > 0 {
+		return transport.rabbitURL
+	}
+	return rabbit.RabbitURL
+}
+
+func (transport amqpTransport) RunPublisher(rabbit *RabbitClient, messages <-chan Raws) {
+	rabbit.publisherRoutine(
+		rabbit.redial(transport.urlOf(rabbit), rabbit.Publisher, nil),
+		messages,
+	)
+}
+
+func (transport amqpTransport) RunSubscriber(rabbit *RabbitClient, messages chan<- Raws) {
+	rabbit.subscriberRoutine(
+		rabbit.redial(
+			transport.urlOf(rabbit),
+			rabbit.Subscriber,
+			rabbit.declareSubscribeQueue,
+		),
+		messages,
+	)
+}
+
+// redial keeps providing sessions until handle is done.
+// failure of dialing or setup is retried with backoff,
+// and handle is done when MaxRedialAttempts is exceeded.
+func (rabbit *RabbitClient) redial(
+	rabbitURL string,
+	handle *RabbitHandle,
+	setup func(ch *amqp.Channel) error,
 ) chan chan session {
 	sessions := make(chan chan session)
 
 	go func() {
 		sess := make(chan session)
+		defer close(sessions)
+		defer close(sess)
+		hasConnected := false
 
 		for {
 			select {
 			case sessions <- sess:
-			case <-ctx.Done():
-				rabbitLogger.Println("shutting down session factory")
+			case <-handle.CTX.Done():
+				rabbitLogger.Info("shutting down session factory", "exchange", rabbit.ExchangeName)
 				return
 			}
 
-			conn, err := amqp.Dial(url)
-			if err != nil {
-				rabbitLogger.Fatalf("cannot (re)dial: %v %q", err, url)
-			}
+			var newSess session
+			for attempt := 1; ; attempt++ {
+				if hasConnected {
+					rabbit.setState(StateReconnecting)
+				}
 
-			ch, err := conn.Channel()
-			if err != nil {
-				rabbitLogger.Fatalf("cannot create channel: %v", err)
-			}
+				var err error
+				newSess, err = rabbit.dial(rabbitURL, setup)
+				if err == nil {
+					break
+				}
+				rabbitLogger.Warning(
+					"dial failed",
+					"exchange", rabbit.ExchangeName,
+					"attempt", attempt,
+					"error", err,
+				)
+				dialFailures.WithLabelValues(rabbit.ExchangeName).Inc()
+
+				if rabbit.MaxRedialAttempts > 0 &&
+					attempt >= rabbit.MaxRedialAttempts {
+					rabbitLogger.Error(
+						"giving up dialing",
+						"exchange", rabbit.ExchangeName,
+						"attempts", attempt,
+					)
+					rabbit.setState(StateFailed)
+					handle.Done()
+					return
+				}
 
-			err = ch.Qos(
-				1,
-				0,
-				false,
-			)
-			if err != nil {
-				rabbitLogger.Fatalln("failed to set QoS")
+				select {
+				case <-time.After(rabbit.backoff(attempt)):
+				case <-handle.CTX.Done():
+					rabbitLogger.Info("shutting down session factory", "exchange", rabbit.ExchangeName)
+					return
+				}
 			}
-
-			err = ch.ExchangeDeclare(
-				exchangeName,
-				exchangeKind,
-				false,
-				true,
-				false,
-				false,
-				nil,
-			)
-			if err != nil {
-				rabbitLogger.Fatalf("cannot declare exchange: %v", err)
+			if hasConnected {
+				reconnects.WithLabelValues(rabbit.ExchangeName).Inc()
 			}
+			hasConnected = true
+			rabbit.setState(StateConnected)
 
 			select {
-			case sess <- session{conn, ch}:
-			case <-ctx.Done():
-				rabbitLogger.Println("shutting down new session")
+			case sess <- newSess:
+			case <-handle.CTX.Done():
+				newSess.close()
+				rabbitLogger.Info("shutting down new session", "exchange", rabbit.ExchangeName)
 				return
 			}
 		}
@@ -255,32 +466,138 @@ func redial(
 	return sessions
 }
 
+func (rabbit *RabbitClient) dial(
+	rabbitURL string,
+	setup func(ch *amqp.Channel) error,
+) (sess session, err error) {
+	conn, err := amqp.Dial(rabbitURL)
+	if err != nil {
+		err = fmt.Errorf("cannot (re)dial: %v %q", err, rabbitURL)
+		return
+	}
+	sess.Connection = conn
+
+	sess.Channel, err = conn.Channel()
+	if err != nil {
+		sess.close()
+		err = fmt.Errorf("cannot create channel: %v", err)
+		return
+	}
+
+	err = sess.Qos(
+		rabbit.Prefetch,
+		0,
+		false,
+	)
+	if err != nil {
+		sess.close()
+		err = fmt.Errorf("failed to set QoS: %v", err)
+		return
+	}
+
+	err = sess.ExchangeDeclare(
+		rabbit.ExchangeName,
+		rabbit.ExchangeKind,
+		rabbit.Durable,
+		!rabbit.Durable,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		sess.close()
+		err = fmt.Errorf("cannot declare exchange: %v", err)
+		return
+	}
+
+	if rabbit.IsServer {
+		// servers publish dead letters
+		err = sess.ExchangeDeclare(
+			DeadLetterExchangeName(rabbit.ExchangeName),
+			ExchangeKindDirect,
+			rabbit.Durable,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			sess.close()
+			err = fmt.Errorf("cannot declare dead letter exchange: %v", err)
+			return
+		}
+	}
+
+	if setup != nil {
+		err = setup(sess.Channel)
+		if err != nil {
+			sess.close()
+		}
+	}
+	return
+}
+
 // publisher
 
 func (rabbit *RabbitClient) publisherRoutine(
 	sessions chan chan session, messages <-chan Raws) {
 
+	// messages not confirmed yet.
+	// kept across sessions, then published again after reconnecting
+	var pending []Raws
+
 	for sess := range sessions {
+		pub, ok := <-sess
+		if !ok {
+			return
+		}
+
 		var (
-			isRunning bool
-			readingCh = messages
-			pendingCh = make(chan Raws, 1)
-			confirmCh = make(chan amqp.Confirmation, 1)
+			waitingConfirm bool
+			confirmCh      = make(chan amqp.Confirmation, 1)
+			closeCh        = pub.Connection.NotifyClose(make(chan *amqp.Error, 1))
 		)
-
-		pub := <-sess
 		err := pub.Confirm(false)
 		if err != nil {
-			rabbitLogger.Printf("publisher confirms not supported %v", err)
-			close(confirmCh)
+			rabbitLogger.Warning(
+				"publisher confirms not supported",
+				"exchange", rabbit.ExchangeName,
+				"error", err,
+			)
+			confirmCh = nil
 		} else {
 			pub.NotifyPublish(confirmCh)
 		}
-		rabbitLogger.Printf("publishing...")
+		rabbitLogger.Info("publishing", "exchange", rabbit.ExchangeName)
 
 	publishLoop:
 		for {
-			var raws Raws
+			publishPending.WithLabelValues(rabbit.ExchangeName).Set(float64(len(pending)))
+			if len(pending) > 0 && !waitingConfirm {
+				err = rabbit.publish(pub, pending[0])
+				if err != nil {
+					rabbitLogger.With(RawsFields(&pending[0])...).Error(
+						"failed to publish",
+						"exchange", rabbit.ExchangeName,
+						"error", err,
+					)
+					pub.close()
+					break publishLoop
+				}
+				publishedTotal.WithLabelValues(rabbit.ExchangeName).Inc()
+				if confirmCh == nil {
+					pending = pending[1:]
+					atomic.AddInt64(&rabbit.unpublished, -1)
+				} else {
+					waitingConfirm = true
+				}
+				continue
+			}
+
+			readingCh := messages
+			if waitingConfirm {
+				readingCh = nil
+			}
 
 			select {
 			case confirmed, ok := <-confirmCh:
@@ -288,109 +605,249 @@ func (rabbit *RabbitClient) publisherRoutine(
 					break publishLoop
 				}
 				if !confirmed.Ack {
-					rabbitLogger.Printf(
-						"nack message %d, body: %q",
-						confirmed.DeliveryTag,
-						string(raws.Body),
+					publishNacks.WithLabelValues(rabbit.ExchangeName).Inc()
+					rabbitLogger.With(RawsFields(&pending[0])...).Error(
+						"message nacked",
+						"exchange", rabbit.ExchangeName,
+						"delivery_tag", confirmed.DeliveryTag,
+						"body", string(pending[0].Body),
 					)
 				}
-				readingCh = messages
-			case raws = <-pendingCh:
-				err := pub.Publish(
-					rabbit.ExchangeName,
-					rabbit.PublishRoutingKey,
-					false,
-					false,
-					amqp.Publishing{
-						ContentType:   rabbit.ContentType,
-						CorrelationId: raws.CorrelationId,
-						Body:          raws.Body,
-					},
+				pending = pending[1:]
+				atomic.AddInt64(&rabbit.unpublished, -1)
+				waitingConfirm = false
+			case e := <-closeCh:
+				rabbitLogger.Warning(
+					"publisher connection closed",
+					"exchange", rabbit.ExchangeName,
+					"error", e,
 				)
-				if err != nil {
-					pendingCh <- raws
-					pub.close()
-					break publishLoop
-				}
-			case raws, isRunning = <-readingCh:
+				break publishLoop
+			case raws, isRunning := <-readingCh:
 				if !isRunning {
+					pub.close()
 					return
 				}
-				pendingCh <- raws
-				readingCh = nil
+				pending = append(pending, raws)
+				atomic.AddInt64(&rabbit.unpublished, 1)
+			case <-rabbit.Publisher.CTX.Done():
+				pub.close()
+				return
 			}
 		}
 	}
 }
 
-// subscriber
+func (rabbit *RabbitClient) publish(pub session, raws Raws) error {
+	contentType := raws.ContentType
+	if len(contentType) == 0 {
+		contentType = rabbit.ContentType
+	}
+	deliveryMode := amqp.Transient
+	if rabbit.Durable {
+		deliveryMode = amqp.Persistent
+	}
+	return pub.Publish(
+		rabbit.exchangeOf(raws),
+		rabbit.routingKeyOf(raws),
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:   contentType,
+			DeliveryMode:  deliveryMode,
+			CorrelationId: raws.CorrelationId,
+			ReplyTo:       raws.ReplyTo,
+			Headers:       amqp.Table(raws.Headers),
+			Body:          raws.Body,
+		},
+	)
+}
 
-func (rabbit *RabbitClient) subscriberRoutine(
-	sessions chan chan session, messages chan<- Raws) {
+func (rabbit *RabbitClient) exchangeOf(raws Raws) string {
+	if len(raws.Exchange) > 0 {
+		return raws.Exchange
+	}
+	return rabbit.ExchangeName
+}
 
-	for sess := range sessions {
-		sub := <-sess
+func (rabbit *RabbitClient) routingKeyOf(raws Raws) string {
+	if len(raws.RoutingKey) > 0 {
+		return raws.RoutingKey
+	}
+	return rabbit.PublishRoutingKey
+}
 
-		_, err := sub.QueueDeclare(
-			rabbit.SubscribeQueueName,
-			false,
-			true,
-			true,
-			false,
-			nil,
-		)
+// subscriber
+
+func (rabbit *RabbitClient) declareSubscribeQueue(ch *amqp.Channel) error {
+	// client queue is exclusive, server queue is shared
+	// and survives restarts when durable
+	durable := rabbit.IsServer && rabbit.Durable
+	var args amqp.Table
+	if rabbit.IsServer {
+		err := rabbit.declareQuarantine(ch)
 		if err != nil {
-			rabbitLogger.Printf(
-				"cannot consume from exclusive queue: %q %v",
-				rabbit.SubscribeQueueName,
-				err,
-			)
-			return
+			return err
 		}
-
-		err = sub.QueueBind(
+		// rejected or expired requests go to quarantine too
+		args = amqp.Table{
+			"x-dead-letter-exchange":    DeadLetterExchangeName(rabbit.ExchangeName),
+			"x-dead-letter-routing-key": QuarantineQueueName(rabbit.SubscribeQueueName),
+		}
+	}
+	_, err := ch.QueueDeclare(
+		rabbit.SubscribeQueueName,
+		durable,
+		!durable,
+		!rabbit.IsServer,
+		false,
+		args,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"cannot declare queue: %q %v",
 			rabbit.SubscribeQueueName,
-			rabbit.SubscribeRoutingKey,
+			err,
+		)
+	}
+
+	err = ch.QueueBind(
+		rabbit.SubscribeQueueName,
+		rabbit.SubscribeRoutingKey,
+		rabbit.ExchangeName,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"cannot cosume without a binding to exchange: %q %v",
 			rabbit.ExchangeName,
-			false,
-			nil,
+			err,
 		)
-		if err != nil {
-			rabbitLogger.Printf(
-				"cannot cosume without a binding to exchange: %q %v",
-				rabbit.ExchangeName,
-				err,
-			)
+	}
+	return nil
+}
+
+func (rabbit *RabbitClient) subscriberRoutine(
+	sessions chan chan session, messages chan<- Raws) {
+
+	// exclusive queues of clients are drained at once
+	var inspecting <-chan time.Time
+	if rabbit.IsServer {
+		ticker := time.NewTicker(queueDepthInterval)
+		defer ticker.Stop()
+		inspecting = ticker.C
+	}
+
+	for sess := range sessions {
+		sub, ok := <-sess
+		if !ok {
 			return
 		}
 
+		consumerTag := uuid.New().String()
 		deliveries, err := sub.Consume(
 			rabbit.SubscribeQueueName,
-			"",
+			consumerTag,
 			false,
-			true,
+			!rabbit.IsServer,
 			false,
 			false,
 			nil,
 		)
 		if err != nil {
-			rabbitLogger.Printf(
-				"cannot consume from: %q %v",
-				rabbit.SubscribeQueueName,
-				err,
+			rabbitLogger.Error(
+				"cannot consume",
+				"queue", rabbit.SubscribeQueueName,
+				"error", err,
 			)
-			return
+			sub.close()
+			continue
 		}
 
-		rabbitLogger.Printf("subscribed...")
+		rabbitLogger.Info("subscribed", "queue", rabbit.SubscribeQueueName)
+		consuming := rabbit.consumeCTX.Done()
+		if rabbit.IsServer {
+			rabbit.observeQueueDepth(sub)
+		}
 
-		for deli := range deliveries {
-			messages <- Raws{
-				Body:          deli.Body,
-				CorrelationId: deli.CorrelationId,
+	consumeLoop:
+		for {
+			select {
+			case deli, ok := <-deliveries:
+				if !ok && consuming == nil {
+					// cancelled by StopConsuming,
+					// the channel stays open for acks until done
+					<-rabbit.Subscriber.CTX.Done()
+					sub.close()
+					return
+				}
+				if !ok {
+					rabbitLogger.Warning(
+						"deliveries closed, resubscribing",
+						"queue", rabbit.SubscribeQueueName,
+					)
+					break consumeLoop
+				}
+				raws := Raws{
+					Body:          deli.Body,
+					CorrelationId: deli.CorrelationId,
+					ContentType:   deli.ContentType,
+					ReplyTo:       deli.ReplyTo,
+					Headers:       deli.Headers,
+				}
+				if rabbit.IsServer {
+					// acked by the handler with Raws.Ack
+					rabbit.track(&raws, deli)
+					messages <- raws
+				} else {
+					messages <- raws
+					sub.Ack(deli.DeliveryTag, false)
+				}
+			case <-inspecting:
+				rabbit.observeQueueDepth(sub)
+			case <-consuming:
+				rabbitLogger.Info("stop consuming", "queue", rabbit.SubscribeQueueName)
+				consuming = nil
+				err = sub.Cancel(consumerTag, false)
+				if err != nil {
+					rabbitLogger.Error(
+						"cannot cancel consumer",
+						"queue", rabbit.SubscribeQueueName,
+						"error", err,
+					)
+				}
+			case <-rabbit.Subscriber.CTX.Done():
+				sub.close()
+				return
 			}
-			sub.Ack(deli.DeliveryTag, false)
 		}
+		sub.close()
+	}
+}
+
+// observeQueueDepth sets queueDepth of the queue of this server
+// and of its quarantine.
+// inspected on a channel of its own, which the broker closes
+// if a queue is missing, not to stop consuming.
+func (rabbit *RabbitClient) observeQueueDepth(sub session) {
+	ch, err := sub.Connection.Channel()
+	if err != nil {
+		rabbitLogger.Warning("cannot inspect queues", "error", err)
+		return
+	}
+	defer ch.Close()
+
+	for _, name := range []string{
+		rabbit.SubscribeQueueName,
+		QuarantineQueueName(rabbit.SubscribeQueueName),
+	} {
+		q, err := ch.QueueInspect(name)
+		if err != nil {
+			rabbitLogger.Warning("cannot inspect queue", "queue", name, "error", err)
+			continue
+		}
+		queueDepth.WithLabelValues(name).Set(float64(q.Messages))
 	}
 }
 
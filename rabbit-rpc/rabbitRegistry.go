@@ -0,0 +1,160 @@
+package rabbitrpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+	"unicode"
+)
+
+// handler registry, replacement of hand written
+// switch on DataTypeName and FunctionToCall
+
+type handlerEntry struct {
+	dataTypeName string
+	handle       func(ctx context.Context, envelop *Envelope) (interface{}, string, error)
+}
+
+type HandlerRegistry struct {
+	handlers    map[string]handlerEntry
+	healthCheck func(ctx context.Context) error
+}
+
+// PingFunction is answered by every server, see Ping
+const PingFunction = "ping"
+
+const HealthCheckTimeout = time.Second * 2
+
+// Ping is both request and response of PingFunction
+type Ping struct {
+	Status string `json:"status"`
+}
+
+// NewHandlerRegistry has PingFunction registered
+func NewHandlerRegistry() *HandlerRegistry {
+	registry := &HandlerRegistry{
+		handlers: make(map[string]handlerEntry),
+	}
+	Register(registry, PingFunction, registry.ping)
+	return registry
+}
+
+// SetHealthCheck sets check run on every ping,
+// such as liveness of database the server depends on.
+func (registry *HandlerRegistry) SetHealthCheck(
+	check func(ctx context.Context) error,
+) {
+	registry.healthCheck = check
+}
+
+func (registry *HandlerRegistry) ping(ctx context.Context, _ *Ping) (*Ping, error) {
+	if registry.healthCheck != nil {
+		ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+		defer cancel()
+		err := registry.healthCheck(ctx)
+		if err != nil {
+			return nil, NewError(
+				ErrorCodeUnavailable,
+				fmt.Sprint("health check failed: ", err.Error()),
+			)
+		}
+	}
+	return &Ping{Status: "ok"}, nil
+}
+
+// Register binds functionToCall to handler.
+// request body is extracted into Req and the result is sent back
+// with the type name of Res, "Slice" suffixed when Res is a slice.
+// ctx carries the trace of the request, see ContextFromRaws.
+// panics on invalid or duplicated names,
+// so that typo is found at start up, not at runtime.
+func Register[Req any, Res any](
+	registry *HandlerRegistry,
+	functionToCall string,
+	handler func(ctx context.Context, req *Req) (*Res, error),
+) {
+	if !isValidFunctionName(functionToCall) {
+		panic(fmt.Sprintf("invalid function name %q", functionToCall))
+	}
+	if _, ok := registry.handlers[functionToCall]; ok {
+		panic(fmt.Sprintf("function %q is already registered", functionToCall))
+	}
+
+	resTypeName := TypeName[Res]()
+	registry.handlers[functionToCall] = handlerEntry{
+		dataTypeName: TypeName[Req](),
+		handle: func(ctx context.Context, envelop *Envelope) (interface{}, string, error) {
+			var req Req
+			e := envelop.Extract(&req)
+			if e != nil {
+				return nil, "", e
+			}
+			res, err := handler(ctx, &req)
+			if err != nil {
+				return nil, "", err
+			}
+			return res, resTypeName, nil
+		},
+	}
+}
+
+// Dispatch calls the handler registered for the envelope.
+// returned error is *RabbitRPCError when the request itself is invalid,
+// otherwise it is the one the handler returned.
+func (registry *HandlerRegistry) Dispatch(
+	ctx context.Context,
+	envelop *Envelope,
+) (dataPtr interface{}, dataTypeName string, err error) {
+	entry, ok := registry.handlers[envelop.FunctionToCall]
+	if !ok {
+		err = ErrorFunctionNotFound
+		return
+	}
+	if entry.dataTypeName != envelop.DataTypeName {
+		err = ErrorTypeNotFound
+		return
+	}
+	started := time.Now()
+	dataPtr, dataTypeName, err = entry.handle(ctx, envelop)
+	handlerDuration.WithLabelValues(envelop.FunctionToCall).Observe(
+		time.Since(started).Seconds(),
+	)
+	if err != nil {
+		handlerErrors.WithLabelValues(envelop.FunctionToCall, CodeOf(err).String()).Inc()
+	}
+	return
+}
+
+func (registry *HandlerRegistry) Functions() (names []string) {
+	for name := range registry.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// TypeName is the name used as DataTypeName for T
+func TypeName[T any]() string {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Slice {
+		return fmt.Sprint(t.Elem().Name(), "Slice")
+	}
+	return t.Name()
+}
+
+func isValidFunctionName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, r := range name {
+		if i == 0 && !unicode.IsLetter(r) {
+			return false
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package rabbitrpc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIsValidFunctionName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"createUser": true,
+		"readUser2":  true,
+		"ping":       true,
+		"":           false,
+		"2users":     false,
+		"read_user":  false,
+		"read.user":  false,
+		"read user":  false,
+		"readUser\n": false,
+	} {
+		if isValidFunctionName(name) != valid {
+			t.Errorf("%q valid is not %t", name, valid)
+		}
+	}
+}
+
+func echo(_ context.Context, ping *Ping) (*Ping, error) {
+	return ping, nil
+}
+
+func TestRegisterPanics(t *testing.T) {
+	for _, name := range []string{"", "read_user", PingFunction, "echo"} {
+		registry := NewHandlerRegistry()
+		Register(registry, "echo", echo)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registered %q", name)
+				}
+			}()
+			Register(registry, name, echo)
+		}()
+	}
+}
+
+func TestDispatchErrorCodes(t *testing.T) {
+	registry := NewHandlerRegistry()
+	Register(registry, "echo", echo)
+	for _, tc := range []struct {
+		function string
+		typeName string
+		code     ErrorCode
+	}{
+		{"unknown", TypeName[Ping](), ErrorCodeNotFound},
+		{"echo", "Unknown", ErrorCodeValidation},
+	} {
+		_, _, err := registry.Dispatch(context.Background(), &Envelope{
+			FunctionToCall: tc.function,
+			DataTypeName:   tc.typeName,
+		})
+		if CodeOf(err) != tc.code {
+			t.Errorf("%s of %s: %v is %s", tc.function, tc.typeName, err, CodeOf(err))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package rabbitrpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// graceful shutdown
+
+const drainInterval = time.Millisecond * 50
+
+// noAck is acknowledger of messages which need no ack,
+// so that they are tracked like broker deliveries
+type noAck struct{}
+
+func (noAck) Ack(multiple bool) error           { return nil }
+func (noAck) Nack(multiple, requeue bool) error { return nil }
+
+// track counts raws as in flight until it is acked or nacked
+func (rabbit *RabbitClient) track(raws *Raws, ack acknowledger) {
+	atomic.AddInt64(&rabbit.inflight, 1)
+	raws.delivery = &delivery{
+		acknowledger: ack,
+		done: func() {
+			atomic.AddInt64(&rabbit.inflight, -1)
+		},
+	}
+}
+
+// Inflight is the number of received messages not acked yet
+func (rabbit *RabbitClient) Inflight() int {
+	return int(atomic.LoadInt64(&rabbit.inflight))
+}
+
+// Unpublished is the number of messages queued in the publisher
+// and not confirmed by the broker yet
+func (rabbit *RabbitClient) Unpublished() int {
+	return int(atomic.LoadInt64(&rabbit.unpublished))
+}
+
+// StopConsuming stops receiving new messages.
+// the channel is kept open so that received ones can be acked.
+func (rabbit *RabbitClient) StopConsuming() {
+	rabbit.stopConsume()
+}
+
+// Shutdown stops consuming, waits for received messages to be acked
+// and for queued messages to be published, then closes the client.
+// the client is closed even when ctx is done before that,
+// then unacked messages are redelivered by the broker.
+func (rabbit *RabbitClient) Shutdown(ctx context.Context) (err error) {
+	defer rabbit.Publisher.Done()
+	defer rabbit.Subscriber.Done()
+
+	rabbit.StopConsuming()
+	err = waitUntil(ctx, func() bool {
+		return rabbit.Inflight() == 0
+	})
+	if err != nil {
+		return
+	}
+	err = waitUntil(ctx, func() bool {
+		return rabbit.Unpublished() == 0
+	})
+	return
+}
+
+// Drain waits until every pending call is resolved or swept
+func (pending *PendingCalls) Drain(ctx context.Context) error {
+	return waitUntil(ctx, func() bool {
+		return pending.Len() == 0
+	})
+}
+
+func waitUntil(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package rabbitrpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// connection state of amqp transport
+
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateReconnecting
+	StateFailed
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// NotifyState registers observer called on every state change
+func (rabbit *RabbitClient) NotifyState(observer func(state ConnectionState)) {
+	rabbit.stateMutex.Lock()
+	defer rabbit.stateMutex.Unlock()
+	rabbit.stateObservers = append(rabbit.stateObservers, observer)
+}
+
+func (rabbit *RabbitClient) State() ConnectionState {
+	rabbit.stateMutex.Lock()
+	defer rabbit.stateMutex.Unlock()
+	return rabbit.state
+}
+
+func (rabbit *RabbitClient) setState(state ConnectionState) {
+	rabbit.stateMutex.Lock()
+	changed := rabbit.state != state
+	rabbit.state = state
+	observers := rabbit.stateObservers
+	rabbit.stateMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	rabbitLogger.Info(
+		"connection state changed",
+		"exchange", rabbit.ExchangeName,
+		"state", state,
+	)
+	for _, observer := range observers {
+		observer(state)
+	}
+}
+
+// exponential backoff with jitter, attempt starts from 1
+func (rabbit *RabbitClient) backoff(attempt int) time.Duration {
+	interval := rabbit.MinRedialInterval
+	for i := 1; i < attempt && interval < rabbit.MaxRedialInterval; i++ {
+		interval *= 2
+	}
+	if interval > rabbit.MaxRedialInterval {
+		interval = rabbit.MaxRedialInterval
+	}
+	if interval <= 0 {
+		return 0
+	}
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,164 @@
+package rabbitrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// trace context, W3C traceparent carried in amqp headers
+
+const HeaderTraceParent = "traceparent"
+
+const (
+	traceVersion  = "00"
+	traceSampled  = "01"
+	traceIdSize   = 16
+	spanIdSize    = 8
+	zeroTraceId   = "00000000000000000000000000000000"
+	zeroSpanId    = "0000000000000000"
+	traceParentSz = 55
+)
+
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+}
+
+type traceKey struct{}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// NewTraceContext starts a new trace
+func NewTraceContext() TraceContext {
+	return TraceContext{
+		TraceId: randomHex(traceIdSize),
+		SpanId:  randomHex(spanIdSize),
+	}
+}
+
+// Child is a new span in the same trace
+func (trace TraceContext) Child() TraceContext {
+	return TraceContext{
+		TraceId: trace.TraceId,
+		SpanId:  randomHex(spanIdSize),
+	}
+}
+
+func (trace TraceContext) IsValid() bool {
+	return len(trace.TraceId) == traceIdSize*2 &&
+		len(trace.SpanId) == spanIdSize*2 &&
+		trace.TraceId != zeroTraceId &&
+		trace.SpanId != zeroSpanId
+}
+
+func (trace TraceContext) TraceParent() string {
+	return fmt.Sprintf(
+		"%s-%s-%s-%s",
+		traceVersion,
+		trace.TraceId,
+		trace.SpanId,
+		traceSampled,
+	)
+}
+
+func (trace TraceContext) String() string {
+	return fmt.Sprintf("trace=%s span=%s", trace.TraceId, trace.SpanId)
+}
+
+// ParseTraceParent reads traceparent header value
+func ParseTraceParent(traceParent string) (trace TraceContext, ok bool) {
+	if len(traceParent) != traceParentSz {
+		return
+	}
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || parts[0] != traceVersion {
+		return
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return
+		}
+	}
+	trace = TraceContext{
+		TraceId: strings.ToLower(parts[1]),
+		SpanId:  strings.ToLower(parts[2]),
+	}
+	ok = trace.IsValid()
+	return
+}
+
+func WithTrace(ctx context.Context, trace TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func TraceFromContext(ctx context.Context) (trace TraceContext, ok bool) {
+	trace, ok = ctx.Value(traceKey{}).(TraceContext)
+	return
+}
+
+// TraceFields are key values of trace in ctx for log lines
+func TraceFields(ctx context.Context) []interface{} {
+	trace, ok := TraceFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return trace.Fields()
+}
+
+func (trace TraceContext) Fields() []interface{} {
+	return []interface{}{
+		"trace_id", trace.TraceId,
+		"span_id", trace.SpanId,
+	}
+}
+
+// Inject puts trace into headers, creating headers if nil
+func (trace TraceContext) Inject(headers map[string]interface{},
+) map[string]interface{} {
+	if headers == nil {
+		headers = make(map[string]interface{})
+	}
+	headers[HeaderTraceParent] = trace.TraceParent()
+	return headers
+}
+
+// TraceFromRaws reads trace the sender put into headers
+func TraceFromRaws(raws *Raws) (trace TraceContext, ok bool) {
+	traceParent, ok := raws.Headers[HeaderTraceParent].(string)
+	if !ok {
+		return
+	}
+	return ParseTraceParent(traceParent)
+}
+
+// RawsFields are key values of raws for log lines,
+// correlation id and the trace in its headers
+func RawsFields(raws *Raws) []interface{} {
+	fields := []interface{}{"correlation_id", raws.CorrelationId}
+	if trace, ok := TraceFromRaws(raws); ok {
+		fields = append(fields, trace.Fields()...)
+	}
+	return fields
+}
+
+// ContextFromRaws is the context for handling raws,
+// with a child span of the sender's trace or a new trace
+func ContextFromRaws(ctx context.Context, raws *Raws) context.Context {
+	trace, ok := TraceFromRaws(raws)
+	if ok {
+		trace = trace.Child()
+	} else {
+		trace = NewTraceContext()
+	}
+	return WithTrace(ctx, trace)
+}
@@ -0,0 +1,46 @@
+package rabbitrpc
+
+import "testing"
+
+func TestParseTraceParent(t *testing.T) {
+	const (
+		traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanId  = "00f067aa0ba902b7"
+	)
+	for _, tc := range []struct {
+		name        string
+		traceParent string
+		ok          bool
+	}{
+		{"valid", "00-" + traceId + "-" + spanId + "-01", true},
+		{"not sampled", "00-" + traceId + "-" + spanId + "-00", true},
+		{"bad version", "01-" + traceId + "-" + spanId + "-01", false},
+		{"zero trace id", "00-" + zeroTraceId + "-" + spanId + "-01", false},
+		{"zero span id", "00-" + traceId + "-" + zeroSpanId + "-01", false},
+		{"not hex", "00-" + traceId[:31] + "x-" + spanId + "-01", false},
+		{"short", "00-" + traceId + "-" + spanId[:15] + "-01", false},
+		{"bad separator", "00_" + traceId + "-" + spanId + "-01", false},
+		{"empty", "", false},
+	} {
+		trace, ok := ParseTraceParent(tc.traceParent)
+		if ok != tc.ok {
+			t.Errorf("%s: ok is %t", tc.name, ok)
+			continue
+		}
+		if ok && (trace.TraceId != traceId || trace.SpanId != spanId) {
+			t.Errorf("%s: parsed %s", tc.name, trace)
+		}
+	}
+}
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	trace := NewTraceContext()
+	parsed, ok := ParseTraceParent(trace.TraceParent())
+	if !ok || parsed != trace {
+		t.Errorf("parsed %s of %s", parsed, trace)
+	}
+	child := trace.Child()
+	if child.TraceId != trace.TraceId || child.SpanId == trace.SpanId {
+		t.Errorf("child %s of %s", child, trace)
+	}
+}
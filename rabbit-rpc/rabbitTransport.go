@@ -0,0 +1,181 @@
+package rabbitrpc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Transport carries Raws of a RabbitClient.
+// RunPublisher sends every message read from messages,
+// RunSubscriber passes every received message to messages.
+// both run until the handle of the client is done.
+type Transport interface {
+	RunPublisher(rabbit *RabbitClient, messages <-chan Raws)
+	RunSubscriber(rabbit *RabbitClient, messages chan<- Raws)
+}
+
+// binder is a Transport which binds the subscribe key of rabbit
+// as soon as it starts, before its RunSubscriber runs,
+// so that nothing sent to rabbit right after is dropped
+type binder interface {
+	bind(rabbit *RabbitClient)
+}
+
+// in process transport
+
+const inProcQueueSize = 64
+
+// InProcBroker is a Transport which routes messages
+// by exchange name and routing key over go channels,
+// for running clients and servers without RabbitMQ.
+// a key has a queue while a client subscribes it.
+// messages to keys nobody subscribes, such as quarantine of
+// dead letters, are dropped as unroutable ones of RabbitMQ,
+// so that publishers are never blocked by them.
+type InProcBroker struct {
+	mutex   sync.Mutex
+	queues  map[string]*inProcQueue
+	dropped uint64
+}
+
+type inProcQueue struct {
+	// exchange/key
+	name        string
+	messages    chan Raws
+	subscribers int
+}
+
+func (q *inProcQueue) observeDepth() {
+	queueDepth.WithLabelValues(q.name).Set(float64(len(q.messages)))
+}
+
+func NewInProcBroker() *InProcBroker {
+	return &InProcBroker{
+		queues: make(map[string]*inProcQueue),
+	}
+}
+
+// Dropped is the number of messages dropped
+// since their keys had no subscriber
+func (broker *InProcBroker) Dropped() uint64 {
+	return atomic.LoadUint64(&broker.dropped)
+}
+
+// Queues is the number of keys subscribed
+func (broker *InProcBroker) Queues() int {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	return len(broker.queues)
+}
+
+func queueName(exchangeName, routingKey string) string {
+	return fmt.Sprintf("%s/%s", exchangeName, routingKey)
+}
+
+func (broker *InProcBroker) bind(rabbit *RabbitClient) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	name := queueName(rabbit.ExchangeName, rabbit.SubscribeRoutingKey)
+	q, ok := broker.queues[name]
+	if !ok {
+		q = &inProcQueue{
+			name:     name,
+			messages: make(chan Raws, inProcQueueSize),
+		}
+		broker.queues[name] = q
+	}
+	q.subscribers++
+}
+
+// unbind removes the queue when its last subscriber leaves,
+// messages left in it are lost
+func (broker *InProcBroker) unbind(rabbit *RabbitClient) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	name := queueName(rabbit.ExchangeName, rabbit.SubscribeRoutingKey)
+	q, ok := broker.queues[name]
+	if !ok {
+		return
+	}
+	q.subscribers--
+	if q.subscribers <= 0 {
+		delete(broker.queues, name)
+		queueDepth.DeleteLabelValues(name)
+	}
+}
+
+// queue of the key, nil if nobody subscribes it
+func (broker *InProcBroker) queue(exchangeName, routingKey string) *inProcQueue {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	return broker.queues[queueName(exchangeName, routingKey)]
+}
+
+func (broker *InProcBroker) RunPublisher(rabbit *RabbitClient, messages <-chan Raws) {
+	rabbitLogger.Info("publishing in process", "exchange", rabbit.ExchangeName)
+
+	for {
+		select {
+		case raws, isRunning := <-messages:
+			if !isRunning {
+				return
+			}
+			exchange, key := rabbit.exchangeOf(raws), rabbit.routingKeyOf(raws)
+			q := broker.queue(exchange, key)
+			if q == nil {
+				atomic.AddUint64(&broker.dropped, 1)
+				droppedMessages.Inc()
+				rabbitLogger.Warning(
+					"dropped message of key without subscriber",
+					"exchange", exchange,
+					"key", key,
+					"correlation_id", raws.CorrelationId,
+				)
+				continue
+			}
+			select {
+			case q.messages <- raws:
+				q.observeDepth()
+			case <-rabbit.Publisher.CTX.Done():
+				return
+			}
+		case <-rabbit.Publisher.CTX.Done():
+			return
+		}
+	}
+}
+
+// RunSubscriber reads the queue bound by start of rabbit
+func (broker *InProcBroker) RunSubscriber(rabbit *RabbitClient, messages chan<- Raws) {
+	q := broker.queue(rabbit.ExchangeName, rabbit.SubscribeRoutingKey)
+	if q == nil {
+		broker.bind(rabbit)
+		q = broker.queue(rabbit.ExchangeName, rabbit.SubscribeRoutingKey)
+	}
+	defer broker.unbind(rabbit)
+	rabbitLogger.Info("subscribed in process", "queue", rabbit.SubscribeQueueName)
+
+	for {
+		select {
+		case raws := <-q.messages:
+			q.observeDepth()
+			if rabbit.IsServer {
+				rabbit.track(&raws, noAck{})
+			}
+			select {
+			case messages <- raws:
+			case <-rabbit.Subscriber.CTX.Done():
+				// never handled, not to be waited for by Shutdown
+				raws.Nack(false)
+				return
+			}
+		case <-rabbit.consumeCTX.Done():
+			// messages left in q are taken by another server, if any
+			<-rabbit.Subscriber.CTX.Done()
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package rabbitrpc
+
+import (
+	"context"
+	"io"
+	"learning-web-chatboard3/logging"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// every poison message and dropped one is logged
+	SetLogger(logging.New(io.Discard, logging.FormatLogfmt, logging.LevelError))
+	os.Exit(m.Run())
+}
+
+func shutdownContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// poisonServer quarantines every message it cannot decode
+// and answers it, as servers of the services do
+func poisonServer(broker *InProcBroker) (server *RabbitClient) {
+	server = NewRPCServerWithTransport(
+		broker,
+		"test.req",
+		"test.res",
+		"test",
+		ExchangeKindDirect,
+		"test.client",
+		"test.server",
+		Options{},
+		func(raws Raws) {
+			defer raws.Ack()
+			_, err := FromRaws(&raws)
+			if err != nil {
+				server.DeadLetter(raws, err)
+			}
+			server.Publisher.Ch <- Raws{
+				Body:          raws.Body,
+				CorrelationId: raws.CorrelationId,
+				ContentType:   raws.ContentType,
+				RoutingKey:    raws.ReplyTo,
+			}
+		},
+	)
+	return
+}
+
+func TestInProcBrokerQuarantineDoesNotBlock(t *testing.T) {
+	broker := NewInProcBroker()
+	server := poisonServer(broker)
+	defer server.Shutdown(shutdownContext(t))
+
+	replies := make(chan Raws)
+	client := NewRPCClientWithTransport(
+		broker,
+		"test.req",
+		"test.res",
+		"test",
+		ExchangeKindDirect,
+		"test.server",
+		"test.client",
+		Options{},
+		func(raws Raws) { replies <- raws },
+	)
+	defer client.Shutdown(shutdownContext(t))
+
+	const count = inProcQueueSize * 2
+	go func() {
+		for i := 0; i < count; i++ {
+			client.Publisher.Ch <- Raws{
+				Body:          []byte("poison"),
+				CorrelationId: client.GenerateCorrelationID(),
+				ContentType:   ContentTypeJSON,
+				ReplyTo:       client.SubscribeRoutingKey,
+			}
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < count; i++ {
+		select {
+		case <-replies:
+		case <-timeout:
+			t.Fatalf("got %d of %d replies", i, count)
+		}
+	}
+	// nobody subscribes quarantine
+	if dropped := broker.Dropped(); dropped != count {
+		t.Errorf("dropped %d, want %d", dropped, count)
+	}
+}
+
+func TestInProcBrokerRemovesQueues(t *testing.T) {
+	broker := NewInProcBroker()
+	server := poisonServer(broker)
+
+	// every client has a reply key of its own
+	for i := 0; i < 3; i++ {
+		client := NewRPCClientWithTransport(
+			broker,
+			"test.req",
+			uniqueName("test.res"),
+			"test",
+			ExchangeKindDirect,
+			"test.server",
+			uniqueName("test.client"),
+			Options{},
+			func(Raws) {},
+		)
+		if queues := broker.Queues(); queues != 2 {
+			t.Errorf("%d queues with a client", queues)
+		}
+		client.Shutdown(shutdownContext(t))
+		// unbound when its subscriber returns
+		err := waitUntil(shutdownContext(t), func() bool {
+			return broker.Queues() == 1
+		})
+		if err != nil {
+			t.Fatalf("%d queues after a client", broker.Queues())
+		}
+	}
+	server.Shutdown(shutdownContext(t))
+	err := waitUntil(shutdownContext(t), func() bool {
+		return broker.Queues() == 0
+	})
+	if err != nil {
+		t.Errorf("%d queues left", broker.Queues())
+	}
+}
+
+func TestInProcBrokerUntracksUnhandled(t *testing.T) {
+	broker := NewInProcBroker()
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	server := NewRPCServerWithTransport(
+		broker,
+		"test.res",
+		"test.req",
+		"test",
+		ExchangeKindDirect,
+		"test.client",
+		"test.server",
+		Options{},
+		func(raws Raws) {
+			defer raws.Ack()
+			handling <- struct{}{}
+			<-release
+		},
+	)
+	client := NewRPCClientWithTransport(
+		broker,
+		"test.req",
+		"test.res",
+		"test",
+		ExchangeKindDirect,
+		"test.server",
+		"test.client",
+		Options{},
+		func(Raws) {},
+	)
+	defer client.Shutdown(shutdownContext(t))
+
+	// the first is handled, the second waits in the subscriber
+	for i := 0; i < 2; i++ {
+		err := client.Send(Raws{Body: []byte("{}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-handling
+	err := waitUntil(shutdownContext(t), func() bool {
+		return server.Inflight() == 2
+	})
+	if err != nil {
+		t.Fatalf("%d in flight", server.Inflight())
+	}
+
+	server.Subscriber.Done()
+	close(release)
+	err = waitUntil(shutdownContext(t), func() bool {
+		return server.Inflight() == 0
+	})
+	if err != nil {
+		t.Errorf("%d in flight", server.Inflight())
+	}
+	server.Publisher.Done()
+}
@@ -2,6 +2,7 @@ package rabbitrpc
 
 import (
 	"encoding/json"
+	"errors"
 )
 
 // req res classification
@@ -29,7 +30,12 @@ type Envelope struct {
 
 	FunctionToCall string `json:"function_to_call"`
 	DataTypeName   string `json:"type_name"`
-	Body           []byte `json:"body"`
+	// body encoded by the same codec as the envelope,
+	// nested as is in json, binary in msgpack
+	Body json.RawMessage `json:"body"`
+
+	// codec which decoded this envelope, used for body too
+	codec Codec
 }
 
 func MakeBin(
@@ -39,9 +45,27 @@ func MakeBin(
 	dataTypeName string,
 	dataPtr interface{},
 ) (binEnvelope []byte, errorJSONMarshaling *RabbitRPCError) {
-	binData, err := json.Marshal(dataPtr)
+	return MakeBinWith(
+		JSONCodec,
+		method,
+		status,
+		functionToCall,
+		dataTypeName,
+		dataPtr,
+	)
+}
+
+func MakeBinWith(
+	codec Codec,
+	method MethodCode,
+	status StatusCode,
+	functionToCall string,
+	dataTypeName string,
+	dataPtr interface{},
+) (binEnvelope []byte, errorMarshaling *RabbitRPCError) {
+	binData, err := codec.Marshal(dataPtr)
 	if err != nil {
-		errorJSONMarshaling = &RabbitRPCError{
+		errorMarshaling = &RabbitRPCError{
 			What: err.Error(),
 		}
 		return
@@ -51,11 +75,11 @@ func MakeBin(
 		Status:         status,
 		FunctionToCall: functionToCall,
 		DataTypeName:   dataTypeName,
-		Body:           binData,
+		Body:           json.RawMessage(binData),
 	}
-	binEnvelope, err = json.Marshal(envelop)
+	binEnvelope, err = codec.Marshal(envelop)
 	if err != nil {
-		errorJSONMarshaling = &RabbitRPCError{
+		errorMarshaling = &RabbitRPCError{
 			What: err.Error(),
 		}
 	}
@@ -64,51 +88,143 @@ func MakeBin(
 
 func FromBin(bin []byte,
 ) (envelop *Envelope, errorJSONUnmarshaling *RabbitRPCError) {
-	envelop = &Envelope{}
-	err := json.Unmarshal(bin, envelop)
+	return FromBinWith(JSONCodec, bin)
+}
+
+func FromBinWith(codec Codec, bin []byte,
+) (envelop *Envelope, errorUnmarshaling *RabbitRPCError) {
+	envelop = &Envelope{codec: codec}
+	err := codec.Unmarshal(bin, envelop)
 	if err != nil {
-		errorJSONUnmarshaling = &RabbitRPCError{
+		errorUnmarshaling = &RabbitRPCError{
 			What: err.Error(),
 		}
 	}
 	return
 }
 
+// FromRaws decodes raws with the codec of its content type
+func FromRaws(raws *Raws,
+) (envelop *Envelope, errorUnmarshaling *RabbitRPCError) {
+	codec, errorUnmarshaling := CodecFor(raws.ContentType)
+	if errorUnmarshaling != nil {
+		return
+	}
+	return FromBinWith(codec, raws.Body)
+}
+
+func (envelop *Envelope) Codec() Codec {
+	if envelop.codec == nil {
+		return JSONCodec
+	}
+	return envelop.codec
+}
+
 func (envelop *Envelope) Extract(dataPtr interface{},
-) (errorJSONUnmarshaling *RabbitRPCError) {
-	err := json.Unmarshal(envelop.Body, dataPtr)
+) (errorUnmarshaling *RabbitRPCError) {
+	body := []byte(envelop.Body)
+	if envelop.Codec().ContentType() == ContentTypeJSON &&
+		len(body) > 0 && body[0] == '"' {
+		// base64 string of the body, sent by older services.
+		// bodies are objects or arrays, never strings
+		var decoded []byte
+		err := json.Unmarshal(body, &decoded)
+		if err != nil {
+			return &RabbitRPCError{What: err.Error()}
+		}
+		body = decoded
+	}
+	err := envelop.Codec().Unmarshal(body, dataPtr)
 	if err != nil {
-		errorJSONUnmarshaling = &RabbitRPCError{
+		errorUnmarshaling = &RabbitRPCError{
 			What: err.Error(),
 		}
 	}
 	return
 }
 
-// callback map for convenience of correlation id check
+// error definitions
 
-type CallbackPool map[string]func(raws Raws)
+// ErrorCode classifies RabbitRPCError.
+// zero value is internal, so errors from services
+// which don't set code are treated as before.
+type ErrorCode int
 
-// error definitions
+const (
+	ErrorCodeInternal ErrorCode = iota
+	ErrorCodeNotFound
+	ErrorCodeValidation
+	ErrorCodeConflict
+	ErrorCodeUnauthorized
+	ErrorCodeUnavailable
+)
+
+func (code ErrorCode) String() string {
+	switch code {
+	case ErrorCodeInternal:
+		return "internal"
+	case ErrorCodeNotFound:
+		return "not found"
+	case ErrorCodeValidation:
+		return "validation"
+	case ErrorCodeConflict:
+		return "conflict"
+	case ErrorCodeUnauthorized:
+		return "unauthorized"
+	case ErrorCodeUnavailable:
+		return "unavailable"
+	default:
+		return "unknown"
+	}
+}
 
 type RabbitRPCError struct {
-	What string `json:"what"`
+	Code ErrorCode `json:"code"`
+	What string    `json:"what"`
 }
 
 const ErrorTypeName = "RabbitRPCError"
 
+func NewError(code ErrorCode, what string) *RabbitRPCError {
+	return &RabbitRPCError{
+		Code: code,
+		What: what,
+	}
+}
+
 func (err *RabbitRPCError) Error() string {
 	return err.What
 }
 
+// CodeOf returns code of err if it is RabbitRPCError,
+// otherwise ErrorCodeInternal
+func CodeOf(err error) ErrorCode {
+	var rpcErr *RabbitRPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code
+	}
+	return ErrorCodeInternal
+}
+
+// a request the server cannot serve is the caller's fault,
+// not an internal error of the server
+
 var ErrorTypeNotFound *RabbitRPCError = &RabbitRPCError{
+	Code: ErrorCodeValidation,
 	What: "type name is unknown",
 }
 
 var ErrorMethodCodeInvalid *RabbitRPCError = &RabbitRPCError{
+	Code: ErrorCodeValidation,
 	What: "method code is invalid",
 }
 
 var ErrorFunctionNotFound *RabbitRPCError = &RabbitRPCError{
+	Code: ErrorCodeNotFound,
 	What: "function name is invalid",
 }
+
+var ErrorPublisherDone *RabbitRPCError = &RabbitRPCError{
+	Code: ErrorCodeUnavailable,
+	What: "publisher is done",
+}
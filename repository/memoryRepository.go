@@ -0,0 +1,356 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"learning-web-chatboard3/common"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// repositories in memory, for local runs and tests.
+// they behave like the xorm ones, lost on exit.
+
+// NewMemory returns empty repositories in memory
+func NewMemory() *Repositories {
+	return &Repositories{
+		Users:    &memoryUsers{},
+		Logins:   &memoryLogins{},
+		Sessions: &memorySessions{},
+		Topics:   &memoryTopics{},
+		Replies:  &memoryReplies{},
+		Ping:     func(context.Context) error { return nil },
+		Close:    func() error { return nil },
+	}
+}
+
+// table keeps rows in order of id, starting from 1
+type table[T any] struct {
+	mutex sync.RWMutex
+	rows  []T
+}
+
+func (t *table[T]) insert(row *T, setId func(row *T, id uint)) {
+	setId(row, uint(len(t.rows)+1))
+	t.rows = append(t.rows, *row)
+}
+
+// find is the first row matching, nil if none
+func (t *table[T]) find(match func(row *T) bool) *T {
+	for i := range t.rows {
+		if match(&t.rows[i]) {
+			return &t.rows[i]
+		}
+	}
+	return nil
+}
+
+// byId is row of id, nil if none or deleted
+func (t *table[T]) byId(id uint, idOf func(row *T) uint) *T {
+	if id == 0 || id > uint(len(t.rows)) {
+		return nil
+	}
+	row := &t.rows[id-1]
+	if idOf(row) != id {
+		return nil
+	}
+	return row
+}
+
+// mergeNonZero copies non-zero fields of src to dst,
+// as xorm updates only non-zero fields
+func mergeNonZero(dst interface{}, src interface{}) {
+	dstVal := reflect.ValueOf(dst).Elem()
+	srcVal := reflect.ValueOf(src).Elem()
+	for i := 0; i < srcVal.NumField(); i++ {
+		if !srcVal.Field(i).IsZero() {
+			dstVal.Field(i).Set(srcVal.Field(i))
+		}
+	}
+}
+
+// users //////////////////////////////////////////////////////////
+
+type memoryUsers struct {
+	table[common.User]
+}
+
+func (repo *memoryUsers) Create(_ context.Context, user *common.User) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	used := repo.find(func(row *common.User) bool {
+		return row.UuId == user.UuId ||
+			row.Name == user.Name ||
+			row.Email == user.Email
+	})
+	if used != nil {
+		return ErrConflict
+	}
+	repo.insert(user, func(row *common.User, id uint) { row.Id = id })
+	return nil
+}
+
+func (repo *memoryUsers) Get(_ context.Context, user *common.User) error {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	found := repo.find(func(row *common.User) bool {
+		return (user.Id == 0 || row.Id == user.Id) &&
+			(common.IsEmpty(user.UuId) || row.UuId == user.UuId) &&
+			(common.IsEmpty(user.Email) || row.Email == user.Email)
+	})
+	if found == nil ||
+		user.Id == 0 && common.IsEmpty(user.UuId) && common.IsEmpty(user.Email) {
+		return ErrNotFound
+	}
+	*user = *found
+	return nil
+}
+
+func (repo *memoryUsers) Update(_ context.Context, user *common.User) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	row := repo.byId(user.Id, func(row *common.User) uint { return row.Id })
+	if row == nil {
+		return ErrNotFound
+	}
+	mergeNonZero(row, user)
+	return nil
+}
+
+// logins /////////////////////////////////////////////////////////
+
+type memoryLogins struct {
+	table[common.Login]
+}
+
+func (repo *memoryLogins) Create(_ context.Context, login *common.Login) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	used := repo.find(func(row *common.Login) bool {
+		return row.Id != 0 && row.UuId == login.UuId
+	})
+	if used != nil {
+		return ErrConflict
+	}
+	repo.insert(login, func(row *common.Login, id uint) { row.Id = id })
+	return nil
+}
+
+func (repo *memoryLogins) Get(_ context.Context, login *common.Login) error {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	found := repo.find(func(row *common.Login) bool {
+		return row.Id != 0 && row.UuId == login.UuId
+	})
+	if found == nil {
+		return ErrNotFound
+	}
+	*login = *found
+	return nil
+}
+
+func (repo *memoryLogins) Update(_ context.Context, login *common.Login) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	row := repo.byId(login.Id, func(row *common.Login) uint { return row.Id })
+	if row == nil {
+		return ErrNotFound
+	}
+	mergeNonZero(row, login)
+	return nil
+}
+
+// deleted rows are zeroed, ids are never reused
+func (repo *memoryLogins) Delete(
+	_ context.Context,
+	login *common.Login,
+) (deleted int64, err error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	if login.Id == 0 && login.UserId == 0 {
+		err = errors.New("need id or user id of login to delete")
+		return
+	}
+	for i := range repo.rows {
+		row := &repo.rows[i]
+		if row.Id == 0 {
+			continue
+		}
+		if login.Id != 0 && row.Id == login.Id ||
+			login.Id == 0 && row.UserId == login.UserId &&
+				(common.IsEmpty(login.Kind) || row.Kind == login.Kind) {
+			*row = common.Login{}
+			deleted++
+		}
+	}
+	return
+}
+
+// sessions ///////////////////////////////////////////////////////
+
+type memorySessions struct {
+	table[common.Session]
+}
+
+func (repo *memorySessions) Create(_ context.Context, sess *common.Session) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	used := repo.find(func(row *common.Session) bool {
+		return row.UuId == sess.UuId
+	})
+	if used != nil {
+		return ErrConflict
+	}
+	repo.insert(sess, func(row *common.Session, id uint) { row.Id = id })
+	return nil
+}
+
+func (repo *memorySessions) Get(_ context.Context, sess *common.Session) error {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	found := repo.find(func(row *common.Session) bool {
+		return row.UuId == sess.UuId
+	})
+	if found == nil {
+		return ErrNotFound
+	}
+	*sess = *found
+	return nil
+}
+
+// topics /////////////////////////////////////////////////////////
+
+type memoryTopics struct {
+	table[common.Topic]
+}
+
+func (repo *memoryTopics) Create(_ context.Context, topic *common.Topic) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	used := repo.find(func(row *common.Topic) bool {
+		return row.UuId == topic.UuId
+	})
+	if used != nil {
+		return ErrConflict
+	}
+	repo.insert(topic, func(row *common.Topic, id uint) { row.Id = id })
+	return nil
+}
+
+func (repo *memoryTopics) Get(_ context.Context, topic *common.Topic) error {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	found := repo.find(func(row *common.Topic) bool {
+		return row.UuId == topic.UuId
+	})
+	if found == nil {
+		return ErrNotFound
+	}
+	*topic = *found
+	return nil
+}
+
+func (repo *memoryTopics) Update(_ context.Context, topic *common.Topic) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	row := repo.byId(topic.Id, func(row *common.Topic) uint { return row.Id })
+	if row == nil {
+		return ErrNotFound
+	}
+	mergeNonZero(row, topic)
+	return nil
+}
+
+func (repo *memoryTopics) UpdateByUuId(_ context.Context, topic *common.Topic) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	row := repo.find(func(row *common.Topic) bool {
+		return row.UuId == topic.UuId
+	})
+	if row == nil {
+		return ErrNotFound
+	}
+	id := row.Id
+	mergeNonZero(row, topic)
+	row.Id = id
+	*topic = *row
+	return nil
+}
+
+func (repo *memoryTopics) IncrementReplies(_ context.Context, topic *common.Topic) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	row := repo.find(func(row *common.Topic) bool {
+		return row.UuId == topic.UuId
+	})
+	if row == nil {
+		return ErrNotFound
+	}
+	row.NumReplies++
+	if !topic.LastUpdate.IsZero() {
+		row.LastUpdate = topic.LastUpdate
+	}
+	*topic = *row
+	return nil
+}
+
+func (repo *memoryTopics) List(_ context.Context) (topics []common.Topic, err error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	topics = append(topics, repo.rows...)
+	sort.SliceStable(topics, func(i, j int) bool {
+		return topics[i].LastUpdate.After(topics[j].LastUpdate)
+	})
+	return
+}
+
+// replies ////////////////////////////////////////////////////////
+
+type memoryReplies struct {
+	table[common.Reply]
+}
+
+func (repo *memoryReplies) Create(_ context.Context, reply *common.Reply) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	used := repo.find(func(row *common.Reply) bool {
+		return row.UuId == reply.UuId
+	})
+	if used != nil {
+		return ErrConflict
+	}
+	repo.insert(reply, func(row *common.Reply, id uint) { row.Id = id })
+	return nil
+}
+
+func (repo *memoryReplies) ListInTopic(
+	_ context.Context,
+	topicId uint,
+) (replies []common.Reply, err error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	for _, row := range repo.rows {
+		if row.TopicId == topicId {
+			replies = append(replies, row)
+		}
+	}
+	return
+}
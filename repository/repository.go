@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/migrations"
+)
+
+// storage of models behind interfaces,
+// so that services run on postgres, sqlite3 or memory alike.
+// methods fill the model passed in, as xorm does.
+
+var (
+	ErrNotFound = errors.New("not found")
+	// unique column is already used
+	ErrConflict = errors.New("conflict")
+)
+
+type UserRepo interface {
+	Create(ctx context.Context, user *common.User) error
+	// Get fills user found by its Id, UuId or Email, whichever are set
+	Get(ctx context.Context, user *common.User) error
+	// Update saves non-zero fields of user of its Id
+	Update(ctx context.Context, user *common.User) error
+}
+
+type LoginRepo interface {
+	Create(ctx context.Context, login *common.Login) error
+	// Get fills login found by its UuId
+	Get(ctx context.Context, login *common.Login) error
+	// Update saves non-zero fields of login of its Id
+	Update(ctx context.Context, login *common.Login) error
+	// Delete removes login of its Id,
+	// or every login of its UserId if Id is zero,
+	// limited to its Kind if not empty
+	Delete(ctx context.Context, login *common.Login) (deleted int64, err error)
+}
+
+type SessionRepo interface {
+	Create(ctx context.Context, sess *common.Session) error
+	// Get fills session found by its UuId
+	Get(ctx context.Context, sess *common.Session) error
+}
+
+type TopicRepo interface {
+	Create(ctx context.Context, topic *common.Topic) error
+	// Get fills topic found by its UuId
+	Get(ctx context.Context, topic *common.Topic) error
+	// Update saves non-zero fields of topic of its Id
+	Update(ctx context.Context, topic *common.Topic) error
+	// UpdateByUuId saves non-zero fields of topic of its UuId,
+	// leaving its Id, then fills topic
+	UpdateByUuId(ctx context.Context, topic *common.Topic) error
+	// IncrementReplies adds one to NumReplies of topic of its UuId
+	// in one statement and saves its LastUpdate, then fills topic
+	IncrementReplies(ctx context.Context, topic *common.Topic) error
+	// List is every topic, latest updated first
+	List(ctx context.Context) ([]common.Topic, error)
+}
+
+type ReplyRepo interface {
+	Create(ctx context.Context, reply *common.Reply) error
+	// ListInTopic is every reply to topic of topicId
+	ListInTopic(ctx context.Context, topicId uint) ([]common.Reply, error)
+}
+
+// Repositories are every repository on one storage
+type Repositories struct {
+	Users    UserRepo
+	Logins   LoginRepo
+	Sessions SessionRepo
+	Topics   TopicRepo
+	Replies  ReplyRepo
+
+	// Ping fails if the storage is unreachable
+	Ping  func(ctx context.Context) error
+	Close func() error
+}
+
+// Open opens the storage of config.DbDriver.
+// database of postgres or sqlite3 must be at the version
+// migrations expect.
+func Open(config *common.Configuration) (repos *Repositories, err error) {
+	switch config.DbDriver {
+	case common.DbDriverMemory:
+		repos = NewMemory()
+		return
+	case common.DbDriverPostgres, common.DbDriverSQLite:
+	default:
+		err = fmt.Errorf("unknown db_driver %q", config.DbDriver)
+		return
+	}
+
+	dbEngine, err := common.OpenDb(config, 0)
+	if err != nil {
+		return
+	}
+	err = migrations.Check(dbEngine)
+	if err != nil {
+		dbEngine.Close()
+		return
+	}
+	repos = NewXorm(dbEngine)
+	return
+}
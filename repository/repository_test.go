@@ -0,0 +1,346 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/migrations"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// every case runs against the memory repositories
+// and the xorm ones on sqlite3, which must behave the same
+
+func openSQLite(t *testing.T) *Repositories {
+	t.Helper()
+	dbEngine, err := common.OpenDb(&common.Configuration{
+		DbDriver: common.DbDriverSQLite,
+		DbName:   filepath.Join(t.TempDir(), "test.db"),
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+	_, err = migrations.Up(dbEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewXorm(dbEngine)
+}
+
+func forEachRepositories(t *testing.T, test func(t *testing.T, repos *Repositories)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory())
+	})
+	t.Run("sqlite3", func(t *testing.T) {
+		test(t, openSQLite(t))
+	})
+}
+
+func createUser(t *testing.T, repos *Repositories, name string) *common.User {
+	t.Helper()
+	user := &common.User{
+		UuId:      common.NewUuIdString(),
+		Name:      name,
+		Email:     name + "@example.com",
+		Password:  "hashed",
+		CreatedAt: time.Now(),
+	}
+	err := repos.Users.Create(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func createLogin(t *testing.T, repos *Repositories, user *common.User, kind string) *common.Login {
+	t.Helper()
+	now := time.Now()
+	login := &common.Login{
+		UuId:       common.NewUuIdString(),
+		UserName:   user.Name,
+		UserId:     user.Id,
+		Kind:       kind,
+		LastUpdate: now,
+		CreatedAt:  now,
+	}
+	err := repos.Logins.Create(context.Background(), login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return login
+}
+
+func TestUserConflict(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		user := createUser(t, repos, "taken")
+		for _, tc := range []struct {
+			name string
+			user common.User
+		}{
+			{"uuid", common.User{UuId: user.UuId, Name: "other", Email: "other@example.com"}},
+			{"name", common.User{UuId: "other", Name: user.Name, Email: "other@example.com"}},
+			{"email", common.User{UuId: "other", Name: "other", Email: user.Email}},
+		} {
+			tc.user.Password = "hashed"
+			tc.user.CreatedAt = time.Now()
+			err := repos.Users.Create(context.Background(), &tc.user)
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("same %s: %v", tc.name, err)
+			}
+		}
+	})
+}
+
+func TestUserGet(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		createUser(t, repos, "first")
+		user := createUser(t, repos, "second")
+		for _, tc := range []struct {
+			name  string
+			key   common.User
+			found bool
+		}{
+			{"id", common.User{Id: user.Id}, true},
+			{"uuid", common.User{UuId: user.UuId}, true},
+			{"email", common.User{Email: user.Email}, true},
+			{"unknown uuid", common.User{UuId: "unknown"}, false},
+			{"unknown email", common.User{Email: "unknown@example.com"}, false},
+			{"unknown id", common.User{Id: user.Id + 1}, false},
+		} {
+			got := tc.key
+			err := repos.Users.Get(context.Background(), &got)
+			if !tc.found {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: %v", tc.name, err)
+				}
+				continue
+			}
+			if err != nil || got.Id != user.Id || got.Name != user.Name {
+				t.Errorf("%s: got %+v, %v", tc.name, got, err)
+			}
+		}
+	})
+}
+
+func TestUpdateNonZeroOnly(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		ctx := context.Background()
+		user := createUser(t, repos, "updated")
+		err := repos.Users.Update(ctx, &common.User{Id: user.Id, Password: "rehashed"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := common.User{UuId: user.UuId}
+		err = repos.Users.Get(ctx, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Password != "rehashed" || got.Name != user.Name || got.Email != user.Email {
+			t.Errorf("got %+v", got)
+		}
+
+		err = repos.Users.Update(ctx, &common.User{Id: user.Id + 1, Password: "rehashed"})
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("update of unknown id: %v", err)
+		}
+	})
+}
+
+func TestLoginDelete(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		ctx := context.Background()
+		user := createUser(t, repos, "logged")
+		other := createUser(t, repos, "other")
+		byId := createLogin(t, repos, user, common.LoginKindBrowser)
+		browser := createLogin(t, repos, user, common.LoginKindBrowser)
+		api := createLogin(t, repos, user, common.LoginKindAPI)
+		kept := createLogin(t, repos, other, common.LoginKindBrowser)
+
+		deleted, err := repos.Logins.Delete(ctx, &common.Login{Id: byId.Id})
+		if err != nil || deleted != 1 {
+			t.Errorf("delete by id: %d, %v", deleted, err)
+		}
+		deleted, err = repos.Logins.Delete(ctx, &common.Login{
+			UserId: user.Id,
+			Kind:   common.LoginKindBrowser,
+		})
+		if err != nil || deleted != 1 {
+			t.Errorf("delete by user id and kind: %d, %v", deleted, err)
+		}
+		for _, tc := range []struct {
+			login *common.Login
+			found bool
+		}{
+			{byId, false},
+			{browser, false},
+			{api, true},
+			{kept, true},
+		} {
+			got := common.Login{UuId: tc.login.UuId}
+			err = repos.Logins.Get(ctx, &got)
+			if tc.found && err != nil || !tc.found && !errors.Is(err, ErrNotFound) {
+				t.Errorf("login %d of kind %s: %v", tc.login.Id, tc.login.Kind, err)
+			}
+		}
+
+		deleted, err = repos.Logins.Delete(ctx, &common.Login{UserId: user.Id})
+		if err != nil || deleted != 1 {
+			t.Errorf("delete by user id: %d, %v", deleted, err)
+		}
+		_, err = repos.Logins.Delete(ctx, &common.Login{})
+		if err == nil {
+			t.Error("deleted without id or user id")
+		}
+
+		// ids of deleted logins are not given again
+		login := createLogin(t, repos, user, common.LoginKindBrowser)
+		if login.Id <= kept.Id {
+			t.Errorf("id %d reused, last was %d", login.Id, kept.Id)
+		}
+	})
+}
+
+func TestTopicList(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		ctx := context.Background()
+		user := createUser(t, repos, "owner")
+		now := time.Now().Truncate(time.Second)
+		for _, tc := range []struct {
+			topic string
+			age   time.Duration
+		}{
+			{"middle", time.Hour},
+			{"latest", 0},
+			{"oldest", 2 * time.Hour},
+		} {
+			err := repos.Topics.Create(ctx, &common.Topic{
+				UuId:       common.NewUuIdString(),
+				Topic:      tc.topic,
+				Owner:      user.Name,
+				UserId:     user.Id,
+				LastUpdate: now.Add(-tc.age),
+				CreatedAt:  now.Add(-tc.age),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		topics, err := repos.Topics.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var order []string
+		for _, topic := range topics {
+			order = append(order, topic.Topic)
+		}
+		if len(order) != 3 || order[0] != "latest" || order[1] != "middle" || order[2] != "oldest" {
+			t.Errorf("listed %v", order)
+		}
+	})
+}
+
+func TestIncrementReplies(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		ctx := context.Background()
+		user := createUser(t, repos, "owner")
+		created := time.Now().Add(-time.Hour).Truncate(time.Second)
+		topic := &common.Topic{
+			UuId:       common.NewUuIdString(),
+			Topic:      "counted",
+			Owner:      user.Name,
+			UserId:     user.Id,
+			LastUpdate: created,
+			CreatedAt:  created,
+		}
+		err := repos.Topics.Create(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// replies at once are all counted
+		const count = 20
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := repos.Topics.IncrementReplies(ctx, &common.Topic{
+					UuId:       topic.UuId,
+					LastUpdate: time.Now(),
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		got := common.Topic{UuId: topic.UuId}
+		err = repos.Topics.Get(ctx, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.NumReplies != count || !got.LastUpdate.After(created) || got.Topic != topic.Topic {
+			t.Errorf("got %+v", got)
+		}
+
+		err = repos.Topics.IncrementReplies(ctx, &common.Topic{UuId: "unknown"})
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("increment of unknown uuid: %v", err)
+		}
+	})
+}
+
+func TestTopicUpdateByUuId(t *testing.T) {
+	forEachRepositories(t, func(t *testing.T, repos *Repositories) {
+		ctx := context.Background()
+		user := createUser(t, repos, "owner")
+		var topics []*common.Topic
+		for _, name := range []string{"first", "second"} {
+			topic := &common.Topic{
+				UuId:       common.NewUuIdString(),
+				Topic:      name,
+				Owner:      user.Name,
+				UserId:     user.Id,
+				LastUpdate: time.Now(),
+				CreatedAt:  time.Now(),
+			}
+			err := repos.Topics.Create(ctx, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			topics = append(topics, topic)
+		}
+
+		// id of the other topic is ignored
+		updated := &common.Topic{
+			Id:    topics[1].Id,
+			UuId:  topics[0].UuId,
+			Topic: "renamed",
+		}
+		err := repos.Topics.UpdateByUuId(ctx, updated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Id != topics[0].Id || updated.Owner != user.Name {
+			t.Errorf("updated %+v", updated)
+		}
+		for i, want := range []string{"renamed", "second"} {
+			got := common.Topic{UuId: topics[i].UuId}
+			err = repos.Topics.Get(ctx, &got)
+			if err != nil || got.Topic != want || got.Id != topics[i].Id {
+				t.Errorf("topic %d is %+v, %v", i, got, err)
+			}
+		}
+
+		err = repos.Topics.UpdateByUuId(ctx, &common.Topic{UuId: "unknown", Topic: "x"})
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("update of unknown uuid: %v", err)
+		}
+	})
+}
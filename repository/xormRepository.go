@@ -0,0 +1,269 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-web-chatboard3/common"
+
+	"xorm.io/xorm"
+)
+
+// repositories on xorm, for postgres and sqlite3
+
+const (
+	usersTable    = "users"
+	loginsTable   = "logins"
+	sessionsTable = "sessions"
+	topicsTable   = "topics"
+	repliesTable  = "replies"
+
+	descendingUpdate = "last_update"
+)
+
+// NewXorm returns repositories on dbEngine, closed with it
+func NewXorm(dbEngine *xorm.Engine) *Repositories {
+	return &Repositories{
+		Users:    &xormUsers{dbEngine},
+		Logins:   &xormLogins{dbEngine},
+		Sessions: &xormSessions{dbEngine},
+		Topics:   &xormTopics{dbEngine},
+		Replies:  &xormReplies{dbEngine},
+		Ping:     dbEngine.PingContext,
+		Close:    dbEngine.Close,
+	}
+}
+
+func insertOne(
+	ctx context.Context,
+	dbEngine *xorm.Engine,
+	table string,
+	bean interface{},
+) (err error) {
+	affected, err := dbEngine.
+		Context(ctx).
+		Table(table).
+		InsertOne(bean)
+	if common.IsUniqueViolation(err) {
+		err = fmt.Errorf("%w: %v", ErrConflict, err)
+		return
+	}
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	return
+}
+
+// getBy fills bean found by its non-zero fields
+func getBy(
+	ctx context.Context,
+	dbEngine *xorm.Engine,
+	table string,
+	bean interface{},
+) (err error) {
+	ok, err := dbEngine.
+		Context(ctx).
+		Table(table).
+		Get(bean)
+	if err == nil && !ok {
+		err = ErrNotFound
+	}
+	return
+}
+
+func updateById(
+	ctx context.Context,
+	dbEngine *xorm.Engine,
+	table string,
+	id uint,
+	bean interface{},
+) (err error) {
+	affected, err := dbEngine.
+		Context(ctx).
+		Table(table).
+		ID(id).
+		Update(bean)
+	if err == nil && affected != 1 {
+		err = ErrNotFound
+	}
+	return
+}
+
+// users //////////////////////////////////////////////////////////
+
+type xormUsers struct {
+	dbEngine *xorm.Engine
+}
+
+func (repo *xormUsers) Create(ctx context.Context, user *common.User) error {
+	return insertOne(ctx, repo.dbEngine, usersTable, user)
+}
+
+func (repo *xormUsers) Get(ctx context.Context, user *common.User) error {
+	found := common.User{Id: user.Id, UuId: user.UuId, Email: user.Email}
+	err := getBy(ctx, repo.dbEngine, usersTable, &found)
+	if err == nil {
+		*user = found
+	}
+	return err
+}
+
+func (repo *xormUsers) Update(ctx context.Context, user *common.User) error {
+	return updateById(ctx, repo.dbEngine, usersTable, user.Id, user)
+}
+
+// logins /////////////////////////////////////////////////////////
+
+type xormLogins struct {
+	dbEngine *xorm.Engine
+}
+
+func (repo *xormLogins) Create(ctx context.Context, login *common.Login) error {
+	return insertOne(ctx, repo.dbEngine, loginsTable, login)
+}
+
+func (repo *xormLogins) Get(ctx context.Context, login *common.Login) error {
+	found := common.Login{UuId: login.UuId}
+	err := getBy(ctx, repo.dbEngine, loginsTable, &found)
+	if err == nil {
+		*login = found
+	}
+	return err
+}
+
+func (repo *xormLogins) Update(ctx context.Context, login *common.Login) error {
+	return updateById(ctx, repo.dbEngine, loginsTable, login.Id, login)
+}
+
+func (repo *xormLogins) Delete(
+	ctx context.Context,
+	login *common.Login,
+) (deleted int64, err error) {
+	session := repo.dbEngine.
+		Context(ctx).
+		Table(loginsTable)
+	switch {
+	case login.Id != 0:
+		session = session.Where("id = ?", login.Id)
+	case login.UserId != 0:
+		session = session.Where("user_id = ?", login.UserId)
+		if !common.IsEmpty(login.Kind) {
+			session = session.And("kind = ?", login.Kind)
+		}
+	default:
+		err = errors.New("need id or user id of login to delete")
+		return
+	}
+	deleted, err = session.Delete(&common.Login{})
+	return
+}
+
+// sessions ///////////////////////////////////////////////////////
+
+type xormSessions struct {
+	dbEngine *xorm.Engine
+}
+
+func (repo *xormSessions) Create(ctx context.Context, sess *common.Session) error {
+	return insertOne(ctx, repo.dbEngine, sessionsTable, sess)
+}
+
+func (repo *xormSessions) Get(ctx context.Context, sess *common.Session) error {
+	found := common.Session{UuId: sess.UuId}
+	err := getBy(ctx, repo.dbEngine, sessionsTable, &found)
+	if err == nil {
+		*sess = found
+	}
+	return err
+}
+
+// topics /////////////////////////////////////////////////////////
+
+type xormTopics struct {
+	dbEngine *xorm.Engine
+}
+
+func (repo *xormTopics) Create(ctx context.Context, topic *common.Topic) error {
+	return insertOne(ctx, repo.dbEngine, topicsTable, topic)
+}
+
+func (repo *xormTopics) Get(ctx context.Context, topic *common.Topic) error {
+	found := common.Topic{UuId: topic.UuId}
+	err := getBy(ctx, repo.dbEngine, topicsTable, &found)
+	if err == nil {
+		*topic = found
+	}
+	return err
+}
+
+func (repo *xormTopics) Update(ctx context.Context, topic *common.Topic) error {
+	return updateById(ctx, repo.dbEngine, topicsTable, topic.Id, topic)
+}
+
+func (repo *xormTopics) UpdateByUuId(ctx context.Context, topic *common.Topic) error {
+	affected, err := repo.dbEngine.
+		Context(ctx).
+		Table(topicsTable).
+		Where("uu_id = ?", topic.UuId).
+		Omit("id").
+		Update(topic)
+	if err == nil && affected != 1 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return repo.Get(ctx, topic)
+}
+
+func (repo *xormTopics) IncrementReplies(ctx context.Context, topic *common.Topic) error {
+	// num_replies = num_replies + 1, concurrent replies are all counted
+	affected, err := repo.dbEngine.
+		Context(ctx).
+		Table(topicsTable).
+		Where("uu_id = ?", topic.UuId).
+		Incr("num_replies").
+		Update(&common.Topic{LastUpdate: topic.LastUpdate})
+	if err == nil && affected != 1 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return repo.Get(ctx, topic)
+}
+
+func (repo *xormTopics) List(ctx context.Context) (topics []common.Topic, err error) {
+	err = repo.dbEngine.
+		Context(ctx).
+		Table(topicsTable).
+		Desc(descendingUpdate).
+		Find(&topics)
+	return
+}
+
+// replies ////////////////////////////////////////////////////////
+
+type xormReplies struct {
+	dbEngine *xorm.Engine
+}
+
+func (repo *xormReplies) Create(ctx context.Context, reply *common.Reply) error {
+	return insertOne(ctx, repo.dbEngine, repliesTable, reply)
+}
+
+func (repo *xormReplies) ListInTopic(
+	ctx context.Context,
+	topicId uint,
+) (replies []common.Reply, err error) {
+	err = repo.dbEngine.
+		Context(ctx).
+		Table(repliesTable).
+		Where("topic_id = ?", topicId).
+		Asc("id").
+		Find(&replies)
+	return
+}
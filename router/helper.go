@@ -1,135 +1,98 @@
-package main
+package router
 
 import (
-	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/keyring"
 	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
-	"math/big"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
-	runeSource         = "aA1bB2cC3dD4eE5fFgGhHiIjJkKlLm0MnNoOpPqQrRsStTuUvV6wW7xX8yY9zZ"
 	loginCookieLabel   = "short-time"
 	sessionCookieLabel = "long-time"
 )
 
 const (
-	aes256KeySize uint          = 32
-	macKeySize    uint          = 64
-	pwSaltSize    uint          = 16
-	numStretching int           = 10000
-	stateSize     uint          = 32
-	longinExp     time.Duration = time.Hour * 8
-	stateExp      time.Duration = time.Minute * 20
-	sessionExp    time.Duration = time.Hour * 24 * 365
+	pwSaltSize uint          = 16
+	longinExp  time.Duration = time.Hour * 8
+	csrfExp    time.Duration = time.Minute * 20
+	sessionExp time.Duration = time.Hour * 24 * 365
+	rpcTimeout time.Duration = time.Second * 5
+	// fire and forget calls are swept after rpcTimeout
+	pendingSweepInterval time.Duration = time.Second * 10
 )
 
-var helper struct {
-	block  cipher.Block
+var errRPCTimeout = errors.New("rpc timed out")
+
+// key of cookies and csrf tokens, by key id
+type helperKey struct {
+	id     string
+	aead   cipher.AEAD
 	macKey []byte
 }
 
-// every time server is restarted, cookie become no longer valid
+var helper struct {
+	// makes every new cookie and csrf token
+	primary *helperKey
+	keys    map[string]*helperKey
+}
+
+// keys are read from key ring of config,
+// without it every restart makes cookies no longer valid
 func startHelper() (err error) {
-	bKyeStr, err := generateString(aes256KeySize)
+	ring, err := keyring.Open(config)
+	if errors.Is(err, keyring.ErrNotConfigured) {
+		logger.Warning("no key ring configured, cookies are lost on restart")
+		ring, err = keyring.New()
+	}
 	if err != nil {
 		return
 	}
-	bKey := []byte(bKyeStr)
-	macKeyStr, err := generateString(macKeySize)
+	err = useKeyRing(ring)
 	if err != nil {
 		return
 	}
-	helper.macKey = []byte(macKeyStr)
-	helper.block, err = aes.NewCipher(bKey)
-	return
-}
-
-func makeHash(plainText string) (hashed string) {
-	asBytes := []byte(plainText)
-	hash := sha256.New()
-	for i := 0; i < numStretching; i++ {
-		asBytes = hash.Sum(asBytes)
-	}
-
-	hashed = fmt.Sprintf("%x", asBytes)
-	return
-}
-
-func processPassword(pw, salt string) (hashed string) {
-	// see these pkgs
-	// https://pkg.go.dev/golang.org/x/crypto/bcrypt
-	// https://pkg.go.dev/golang.org/x/crypto/scrypt
-
-	hashed = makeHash(fmt.Sprint(salt, pw))
+	logger.Info(
+		"loaded key ring",
+		"primary", ring.Primary,
+		"keys", len(ring.Keys),
+	)
 	return
 }
 
-func generateString(length uint) (str string, err error) {
-	var i uint
-	maxEx := int64(len(runeSource))
-	runePool := []rune(runeSource)
-	for i = 0; i < length; i++ {
-		bigN, err := rand.Int(rand.Reader, big.NewInt(maxEx))
+// useKeyRing makes helper use keys of ring
+func useKeyRing(ring *keyring.Ring) (err error) {
+	helper.keys = make(map[string]*helperKey, len(ring.Keys))
+	for _, key := range ring.Keys {
+		block, err := aes.NewCipher(key.Cipher)
 		if err != nil {
-			break
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		helper.keys[key.Id] = &helperKey{
+			id:     key.Id,
+			aead:   aead,
+			macKey: key.MAC,
 		}
-		n := bigN.Uint64()
-		str = fmt.Sprint(str, string(runePool[n]))
-	}
-	return
-}
-
-func encrypt(plainText string) (cipherText []byte, err error) {
-	cipherText = make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
-	n, err := io.ReadFull(rand.Reader, iv)
-	if err != nil {
-		err = fmt.Errorf("%s: returned %d", err.Error(), n)
-		return
 	}
-
-	encryptStream := cipher.NewCTR(helper.block, iv)
-	encryptStream.XORKeyStream(cipherText[aes.BlockSize:], []byte(plainText))
+	helper.primary = helper.keys[ring.Primary]
 	return
 }
 
-func decrypt(cipherText []byte) (plainText string, err error) {
-	decryptText := make([]byte, len(cipherText[aes.BlockSize:]))
-	decryptStream := cipher.NewCTR(helper.block, cipherText[:aes.BlockSize])
-	decryptStream.XORKeyStream(decryptText, cipherText[aes.BlockSize:])
-	plainText = string(decryptText)
-	return
-}
-
-func makeMAC(value []byte) []byte {
-	hash := hmac.New(sha256.New, helper.macKey)
-	hash.Write(value)
-	return hash.Sum(nil)
-}
-
-func verifyMAC(mac []byte, value []byte) bool {
-	hash := hmac.New(sha256.New, helper.macKey)
-	hash.Write(value)
-	hashedVal := hash.Sum(nil)
-	return hmac.Equal(mac, hashedVal)
-}
-
 func encode(value []byte) string {
 	return base64.URLEncoding.EncodeToString(value)
 }
@@ -138,79 +101,173 @@ func decode(encoded string) ([]byte, error) {
 	return base64.URLEncoding.DecodeString(encoded)
 }
 
+// sendRequest does not wait for the response,
+// only the trace is taken from ctx so that the request
+// outlives the http request that sent it.
+// callback runs after the handler returned, when the gin context
+// is reused by another request, so it must not touch that context.
 func sendRequest(
+	ctx context.Context,
 	client *rabbitrpc.RabbitClient,
 	functionToCall string,
 	dataTypeName string,
 	dataPtr interface{},
 	callback func(raws rabbitrpc.Raws),
 ) error {
-	corrId := client.GenerateCorrelationID()
-	callbackPool[corrId] = func(raws rabbitrpc.Raws) {
-		callback(raws)
-		doneCh <- raws.CorrelationId
+	detached := context.Background()
+	if trace, ok := rabbitrpc.TraceFromContext(ctx); ok {
+		detached = rabbitrpc.WithTrace(detached, trace)
 	}
-	bin, err := rabbitrpc.MakeBin(
+	_, err := publishRequest(
+		detached,
+		client,
+		functionToCall,
+		dataTypeName,
+		dataPtr,
+		callback,
+	)
+	return err
+}
+
+func publishRequest(
+	ctx context.Context,
+	client *rabbitrpc.RabbitClient,
+	functionToCall string,
+	dataTypeName string,
+	dataPtr interface{},
+	callback func(raws rabbitrpc.Raws),
+) (corrId string, err error) {
+	codec, e := rabbitrpc.CodecFor(client.ContentType)
+	if e != nil {
+		err = e
+		return
+	}
+	bin, e := rabbitrpc.MakeBinWith(
+		codec,
 		0,
 		0,
 		functionToCall,
 		dataTypeName,
 		dataPtr,
 	)
-	if err != nil {
-		return err
+	if e != nil {
+		err = e
+		return
+	}
+
+	corrId = client.GenerateCorrelationID()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rpcTimeout)
 	}
+	pendingCalls.Add(corrId, functionToCall, deadline, callback)
 
-	client.Publisher.Ch <- rabbitrpc.Raws{
+	select {
+	case client.Publisher.Ch <- rabbitrpc.Raws{
 		Body:          bin,
 		CorrelationId: corrId,
+		ContentType:   codec.ContentType(),
+		ReplyTo:       client.SubscribeRoutingKey,
+		Headers:       traceHeaders(ctx),
+	}:
+	case <-ctx.Done():
+		pendingCalls.Remove(corrId)
+		err = ctxError(ctx)
 	}
-	return nil
+	return
 }
 
-func sendRequestAndWait(
+// every request is a child span of the trace in ctx
+func traceHeaders(ctx context.Context) map[string]interface{} {
+	trace, ok := rabbitrpc.TraceFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return trace.Child().Inject(nil)
+}
+
+var callErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "router_call_errors_total",
+	Help: "Calls to services answered with error by function and code, timeout if not answered in time.",
+}, []string{"function", "code"})
+
+// call sends a request and waits for the response into resultPtr.
+// it gives up when ctx is done or rpcTimeout has passed,
+// and the abandoned callback is removed from pendingCalls.
+func call(
+	ctx context.Context,
 	client *rabbitrpc.RabbitClient,
 	functionToCall string,
 	dataTypeName string,
 	dataPtr interface{},
-	callback func(raws rabbitrpc.Raws) error,
-) error {
-	wait := make(chan error)
-	go func() {
-		err := sendRequest(
-			client,
-			functionToCall,
-			dataTypeName,
-			dataPtr,
-			func(raws rabbitrpc.Raws) {
-				e := callback(raws)
-				wait <- e
-			},
-		)
-		if err != nil {
-			wait <- err
-		}
-	}()
+	resultPtr interface{},
+) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+
+	// buffered, a late response must not block the callback
+	wait := make(chan rabbitrpc.Raws, 1)
+	corrId, err := publishRequest(
+		ctx,
+		client,
+		functionToCall,
+		dataTypeName,
+		dataPtr,
+		func(raws rabbitrpc.Raws) {
+			wait <- raws
+		},
+	)
+	if err != nil {
+		return
+	}
+
 	select {
-	case e := <-wait:
-		return e
+	case raws := <-wait:
+		err = extract(&raws, resultPtr)
+	case <-ctx.Done():
+		pendingCalls.Remove(corrId)
+		err = ctxError(ctx)
+	}
+	if err != nil {
+		callErrors.WithLabelValues(functionToCall, errorLabelOf(err)).Inc()
+	}
+	return
+}
+
+func errorLabelOf(err error) string {
+	switch {
+	case errors.Is(err, errRPCTimeout):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return rabbitrpc.CodeOf(err).String()
 	}
 }
 
+func ctxError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errRPCTimeout
+	}
+	return ctx.Err()
+}
+
 func extract(raws *rabbitrpc.Raws, dataPtr interface{}) error {
-	envelop, e := rabbitrpc.FromBin(raws.Body)
+	envelop, e := rabbitrpc.FromRaws(raws)
 	if e != nil {
 		return errors.New(e.What)
 	}
 
 	if envelop.Status == rabbitrpc.StatusError {
-		common.LogWarning(logger).Println("returned status is error")
+		logger.With(rabbitrpc.RawsFields(raws)...).Warning(
+			"returned status is error",
+		)
 		rerr := &rabbitrpc.RabbitRPCError{}
 		e = envelop.Extract(rerr)
 		if e != nil {
 			return errors.New(e.What)
 		}
-		return errors.New(rerr.What)
+		return rerr
 	}
 
 	e = envelop.Extract(dataPtr)
@@ -225,27 +282,30 @@ func checkLoggedIn(ctx *gin.Context) (err error) {
 	if err != nil {
 		return
 	}
+	err = checkLoginOf(ctx, uuid)
+	return
+}
+
+// checkLoginOf stores login of uuid in ctx if it exists
+func checkLoginOf(ctx *gin.Context, uuid string) (err error) {
 	login := &common.Login{
 		UuId: uuid,
 	}
 
-	err = sendRequestAndWait(
+	loginPtr := &common.Login{}
+	err = call(
+		ctx.Request.Context(),
 		usersClient,
 		"readLogin",
 		"Login",
 		login,
-		func(raws rabbitrpc.Raws) (e error) {
-			loginPtr := &common.Login{}
-			e = extract(&raws, loginPtr)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-				return
-			}
-
-			ctx.Set(loginPtrLabel, loginPtr)
-			return
-		},
+		loginPtr,
 	)
+	if err != nil {
+		return
+	}
+
+	ctx.Set(loginPtrLabel, loginPtr)
 	return
 }
 
@@ -259,8 +319,10 @@ func checkSession(ctx *gin.Context) (err error) {
 	}
 	if err != nil {
 		if gin.IsDebugging() {
-			common.LogWarning(logger).
-				Printf("creating new session because [%s]\n", err.Error())
+			requestLogger(ctx).Debug(
+				"creating new session",
+				"reason", err,
+			)
 		}
 		sess, err = requestSessionCreate(ctx)
 		if err != nil {
@@ -303,28 +365,21 @@ func storeCookie(
 	sessionDuration time.Duration,
 	cookieDuration int,
 ) (err error) {
-	//add exp
-	value = fmt.Sprintf(
-		"%s||%d",
+	valToStore, err := sealCookie(
+		cookieName,
 		value,
-		time.Now().Add(sessionDuration).Unix(),
+		time.Now().Add(sessionDuration),
 	)
-	encrypted, err := encrypt(value)
 	if err != nil {
 		return
 	}
-	// add mac value first
-	bytesVal := makeMAC(encrypted)
-	// separated '||'
-	bytesVal = append(bytesVal, []byte("||")...)
-	// add encrypted value
-	bytesVal = append(bytesVal, encrypted...)
-
-	valToStore := encode(bytesVal)
 
 	if gin.IsDebugging() {
-		common.LogInfo(logger).
-			Printf("stored cookie [%s] %s\n", cookieName, valToStore)
+		requestLogger(ctx).Debug(
+			"stored cookie",
+			"name", cookieName,
+			"value", valToStore,
+		)
 	}
 	ctx.SetSameSite(http.SameSiteStrictMode)
 	ctx.SetCookie(
@@ -344,108 +399,22 @@ func pickupCookie(ctx *gin.Context, name string) (value string, err error) {
 	if err != nil {
 		return
 	}
-	bytesVal, err := decode(rawStored)
+	value, err = openCookie(name, rawStored)
 	if err != nil {
-		return
-	}
-	splited := bytes.SplitN(bytesVal, []byte("||"), 2)
-	mac := splited[0]
-	encrypted := splited[1]
-	if !verifyMAC(mac, encrypted) {
-		err = fmt.Errorf("invalid cookie %s", rawStored)
-		return
-	}
-	decrypted, err := decrypt(encrypted)
-	if err != nil {
-		return
-	}
-	value, unixTimeStr, ok := strings.Cut(decrypted, "||")
-	if !ok {
-		err = errors.New("separator not found")
-		return
+		err = fmt.Errorf("cookie %s: %w", name, err)
 	}
-	unixTime, err := strconv.ParseInt(unixTimeStr, 10, 64)
-	if err != nil {
-		return
-	}
-
-	if unixTime < time.Now().Unix() {
-		err = errors.New("session expired")
-	}
-	return
-}
-
-func generateLoginState(ctx *gin.Context) (stateAndMACEncoded string, err error) {
-	login, err := getLoginPtrFromCTX(ctx)
-	if err != nil {
-		return
-	}
-
-	login.State, stateAndMACEncoded, err = generateState()
-	if err != nil {
-		return
-	}
-	err = requestLoginUpdate(login, ctx)
-	if err != nil {
-		return
-	}
-	ctx.Set(loginPtrLabel, login)
-	return
-}
-
-func generateSessionState(ctx *gin.Context) (stateAndMACEncoded string, err error) {
-	sess, err := getSessionPtrFromCTX(ctx)
-	if err != nil {
-		return
-	}
-
-	sess.State, stateAndMACEncoded, err = generateState()
-	if err != nil {
-		return
-	}
-	err = requestSessionUpdate(sess, ctx)
-	if err != nil {
-		return
-	}
-	ctx.Set(sessionPtrLabel, sess)
-	return
-}
-
-func generateState() (stateRaw, stateAndMACEncoded string, err error) {
-	state, err := generateString(stateSize)
-	if err != nil {
-		return
-	}
-	state = fmt.Sprintf(
-		"%s||%d",
-		state,
-		time.Now().Add(stateExp).Unix(),
-	)
-	stateRaw = state
-
-	// same proc with cookie
-	stateAsBytes := []byte(state)
-	bytesVal := makeMAC(stateAsBytes)
-	bytesVal = append(bytesVal, []byte("||")...)
-	bytesVal = append(bytesVal, stateAsBytes...)
-	stateAndMACEncoded = encode(bytesVal)
 	return
 }
 
 func requestSessionCreate(ctx *gin.Context) (sess *common.Session, err error) {
 	sess = &common.Session{}
-	err = sendRequestAndWait(
+	err = call(
+		ctx.Request.Context(),
 		sessionsClient,
 		"createSession",
 		"Session",
 		sess,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, sess)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+		sess,
 	)
 	return
 }
@@ -456,135 +425,13 @@ func requesSessionExist(ctx *gin.Context) (sess *common.Session, err error) {
 		return
 	}
 
-	err = sendRequestAndWait(
+	err = call(
+		ctx.Request.Context(),
 		sessionsClient,
 		"readSession",
 		"Session",
 		sess,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, sess)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
-	)
-	return
-}
-
-func requestSessionUpdate(sess *common.Session, ctx *gin.Context) (err error) {
-	err = sendRequest(
-		sessionsClient,
-		"updateSession",
-		"Session",
 		sess,
-		func(raws rabbitrpc.Raws) {
-			sessPtr := &common.Session{}
-			e := extract(&raws, sessPtr)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
-	)
-	return
-}
-
-func requestLoginUpdate(login *common.Login, ctx *gin.Context) (err error) {
-	err = sendRequest(
-		usersClient,
-		"updateLogin",
-		"Login",
-		login,
-		func(raws rabbitrpc.Raws) {
-			loginPtr := &common.Login{}
-			e := extract(&raws, loginPtr)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
 	)
 	return
 }
-
-func checkState(exposedVal, privateVal string) (err error) {
-	if strings.Compare(exposedVal, "") == 0 {
-		err = errors.New("exposed value is empty")
-		return
-	}
-	if strings.Compare(privateVal, "") == 0 {
-		err = errors.New("private value is empty")
-		return
-	}
-
-	bytesVal, err := decode(exposedVal)
-	if err != nil {
-		return
-	}
-	splited := bytes.SplitN(bytesVal, []byte("||"), 2)
-	// mac can store any bytes,
-	// this should be URL encoded until validation
-	macStored := splited[0]
-	stateStored := string(splited[1])
-
-	if !verifyMAC(macStored, []byte(privateVal)) {
-		err = errors.New("invalid mac")
-		return
-	}
-	if strings.Compare(stateStored, privateVal) != 0 {
-		err = errors.New("invalid state")
-		return
-	}
-	_, unixTimeStr, ok := strings.Cut(stateStored, "||")
-	if !ok {
-		err = errors.New("separator not found")
-		return
-	}
-	unixTime, err := strconv.ParseInt(unixTimeStr, 10, 64)
-	if err != nil {
-		return
-	}
-	if unixTime < time.Now().Unix() {
-		err = errors.New("state expired")
-	}
-	return
-}
-
-func loginStateCheckProcess(ctx *gin.Context) (login *common.Login, err error) {
-	login, err = getLoginPtrFromCTX(ctx)
-	if err != nil {
-		return
-	}
-
-	// check state
-	state := ctx.PostForm("state")
-	err = checkState(state, login.State)
-	if err != nil {
-		return
-	}
-
-	// state is consumed, delete it
-	login.State = ""
-	err = requestLoginUpdate(login, ctx)
-	return
-}
-
-func sessionStateCheckProcess(ctx *gin.Context) (sess *common.Session, err error) {
-	sess, err = getSessionPtrFromCTX(ctx)
-	if err != nil {
-		return
-	}
-
-	// check state
-	state := ctx.PostForm("state")
-	err = checkState(state, sess.State)
-	if err != nil {
-		return
-	}
-
-	// state is consumed, delete it
-	sess.State = ""
-	err = requestSessionUpdate(sess, ctx)
-	return
-}
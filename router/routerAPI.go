@@ -0,0 +1,354 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"learning-web-chatboard3/common"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// json api under /api/v1, calling services as the html pages do.
+// logins are told by Authorization: Bearer <token>,
+// the token is answered by POST /api/v1/login.
+// errors are answered as {"error": "<message>"}.
+
+const (
+	apiPrefix = "/api/v1"
+	// sealed in the cookie format, apart from cookies
+	apiTokenLabel = "api-token"
+	bearerPrefix  = "Bearer "
+)
+
+var errLoginRequired = rabbitrpc.NewError(
+	rabbitrpc.ErrorCodeUnauthorized,
+	"login required",
+)
+
+type apiTopic struct {
+	Id         string    `json:"id"`
+	Topic      string    `json:"topic"`
+	Owner      string    `json:"owner"`
+	NumReplies uint      `json:"num_replies"`
+	LastUpdate time.Time `json:"last_update"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type apiReply struct {
+	Id          string    `json:"id"`
+	Body        string    `json:"body"`
+	Contributor string    `json:"contributor"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiUser struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type apiTopicRequest struct {
+	Topic string `json:"topic" binding:"required"`
+}
+
+type apiReplyRequest struct {
+	Body string `json:"body" binding:"required"`
+}
+
+type apiSignupRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+type apiLoginRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+func toAPITopic(topic *common.Topic) apiTopic {
+	return apiTopic{
+		Id:         topic.AsURL(),
+		Topic:      topic.Topic,
+		Owner:      topic.Owner,
+		NumReplies: topic.NumReplies,
+		LastUpdate: topic.LastUpdate,
+		CreatedAt:  topic.CreatedAt,
+	}
+}
+
+func toAPIReply(reply *common.Reply) apiReply {
+	return apiReply{
+		Id:          reply.AsURL(),
+		Body:        reply.Body,
+		Contributor: reply.Contributor,
+		CreatedAt:   reply.CreatedAt,
+	}
+}
+
+// password is never answered
+func toAPIUser(user *common.User) apiUser {
+	return apiUser{
+		Id:        user.AsURL(),
+		Name:      user.Name,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+func setupAPI(webEngine *gin.Engine) {
+	apiRoute := webEngine.Group(apiPrefix)
+	apiRoute.Use(
+		SetCommonHeadersMiddleware,
+		APIAuthMiddleware,
+	)
+	apiRoute.GET("/topics", apiTopicsGet)
+	apiRoute.POST("/topics", apiTopicsPost)
+	apiRoute.GET("/topics/:id", apiTopicGet)
+	apiRoute.GET("/topics/:id/replies", apiRepliesGet)
+	apiRoute.POST("/topics/:id/replies", apiRepliesPost)
+	apiRoute.POST("/users", apiUsersPost)
+	apiRoute.POST("/login", apiLoginPost)
+	apiRoute.POST("/logout", apiLogoutPost)
+	apiRoute.GET("/me", apiMeGet)
+}
+
+// apiError answers err as json with the status of its code
+func apiError(ctx *gin.Context, err error) {
+	status, msg := httpStatusOf(err)
+	if status >= http.StatusInternalServerError {
+		requestLogger(ctx).Error("api call failed", "error", err)
+	} else {
+		requestLogger(ctx).Warning("api call failed", "error", err)
+	}
+	if status == http.StatusUnauthorized {
+		ctx.Header("WWW-Authenticate", "Bearer")
+	}
+	ctx.AbortWithStatusJSON(status, gin.H{"error": msg})
+}
+
+// apiNoRoute answers unknown paths under /api/v1 as json,
+// leaving others to gin
+func apiNoRoute(ctx *gin.Context) {
+	if strings.HasPrefix(ctx.Request.URL.Path, apiPrefix+"/") {
+		apiError(ctx, rabbitrpc.NewError(rabbitrpc.ErrorCodeNotFound, "no such api"))
+	}
+}
+
+// bindJSON reads body of request into req,
+// answering 400 if it is not valid
+func bindJSON(ctx *gin.Context, req interface{}) bool {
+	err := ctx.ShouldBindJSON(req)
+	if err != nil {
+		apiError(ctx, rabbitrpc.NewError(rabbitrpc.ErrorCodeValidation, err.Error()))
+		return false
+	}
+	return true
+}
+
+// APIAuthMiddleware stores login of the bearer token,
+// requests without Authorization go on without login
+func APIAuthMiddleware(ctx *gin.Context) {
+	header := ctx.GetHeader("Authorization")
+	if len(header) == 0 {
+		ctx.Next()
+		return
+	}
+
+	err := errors.New("not a bearer token")
+	if strings.HasPrefix(header, bearerPrefix) {
+		var uuid string
+		uuid, err = openCookie(apiTokenLabel, strings.TrimPrefix(header, bearerPrefix))
+		if err == nil {
+			err = checkLoginOf(ctx, uuid)
+		}
+	}
+	if errors.Is(err, errRPCTimeout) {
+		apiError(ctx, err)
+		return
+	}
+	if err != nil {
+		apiError(ctx, rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeUnauthorized,
+			fmt.Sprint("invalid token: ", err),
+		))
+		return
+	}
+	ctx.Next()
+}
+
+// apiLogin is login of the bearer token,
+// answering 401 if there is none
+func apiLogin(ctx *gin.Context) (login *common.Login, ok bool) {
+	login, err := getLoginPtrFromCTX(ctx)
+	if err != nil {
+		apiError(ctx, errLoginRequired)
+		return
+	}
+	ok = true
+	return
+}
+
+func apiTopicsGet(ctx *gin.Context) {
+	topics, err := indexGetInternal(ctx)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	answer := make([]apiTopic, 0, len(topics))
+	for i := range topics {
+		answer = append(answer, toAPITopic(&topics[i]))
+	}
+	ctx.JSON(http.StatusOK, answer)
+}
+
+func apiTopicsPost(ctx *gin.Context) {
+	login, ok := apiLogin(ctx)
+	if !ok {
+		return
+	}
+	var req apiTopicRequest
+	if !bindJSON(ctx, &req) {
+		return
+	}
+
+	topic, err := createTopic(ctx, login, req.Topic)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	answer := toAPITopic(topic)
+	ctx.Header("Location", fmt.Sprint(apiPrefix, "/topics/", answer.Id))
+	ctx.JSON(http.StatusCreated, answer)
+}
+
+func apiTopicGet(ctx *gin.Context) {
+	topic, err := readTopicOf(ctx, ctx.Param("id"))
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, toAPITopic(topic))
+}
+
+func apiRepliesGet(ctx *gin.Context) {
+	topic, err := readTopicOf(ctx, ctx.Param("id"))
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	replies, err := readRepliesOf(ctx, topic)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	answer := make([]apiReply, 0, len(replies))
+	for i := range replies {
+		answer = append(answer, toAPIReply(&replies[i]))
+	}
+	ctx.JSON(http.StatusOK, answer)
+}
+
+func apiRepliesPost(ctx *gin.Context) {
+	login, ok := apiLogin(ctx)
+	if !ok {
+		return
+	}
+	var req apiReplyRequest
+	if !bindJSON(ctx, &req) {
+		return
+	}
+
+	topic, err := readTopicOf(ctx, ctx.Param("id"))
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	reply, err := createReply(ctx, login, topic, req.Body)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, toAPIReply(reply))
+}
+
+func apiUsersPost(ctx *gin.Context) {
+	var req apiSignupRequest
+	if !bindJSON(ctx, &req) {
+		return
+	}
+
+	user, err := signup(ctx, req.Name, req.Email, req.Password)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, toAPIUser(user))
+}
+
+func apiLoginPost(ctx *gin.Context) {
+	var req apiLoginRequest
+	if !bindJSON(ctx, &req) {
+		return
+	}
+
+	login, err := authenticate(ctx, req.Email, req.Password, common.LoginKindAPI)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	// as sealed, in seconds
+	expiry := time.Now().Add(longinExp).Truncate(time.Second)
+	token, err := sealCookie(apiTokenLabel, login.UuId, expiry)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, apiToken{Token: token, ExpiresAt: expiry.UTC()})
+}
+
+func apiLogoutPost(ctx *gin.Context) {
+	login, ok := apiLogin(ctx)
+	if !ok {
+		return
+	}
+
+	err := logout(ctx, login)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func apiMeGet(ctx *gin.Context) {
+	login, ok := apiLogin(ctx)
+	if !ok {
+		return
+	}
+
+	user := common.User{Id: login.UserId}
+	err := call(
+		ctx.Request.Context(),
+		usersClient,
+		"readUser",
+		"User",
+		&user,
+		&user,
+	)
+	if err != nil {
+		apiError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, toAPIUser(&user))
+}
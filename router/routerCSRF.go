@@ -0,0 +1,108 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// csrf tokens are stateless, nothing is stored to check them.
+//   v1.<key id>.<base64 of expiry and HMAC-SHA256>
+// the mac covers the session, the form action and the expiry,
+// so that every form of every tab is valid until it expires.
+
+const (
+	csrfFieldName = "csrf_token"
+	csrfLabel     = "csrf"
+)
+
+var errNoSession = errors.New("no session")
+
+// csrfToken is token of form posted to action in session of sessId
+func csrfToken(sessId, action string, expiry time.Time) string {
+	key := helper.primary
+	payload := make([]byte, expirySize, expirySize+sha256.Size)
+	binary.BigEndian.PutUint64(payload, uint64(expiry.Unix()))
+	payload = append(payload, csrfMAC(key, sessId, action, payload)...)
+	return joinFormat(key, payload)
+}
+
+// checkCSRFToken reports whether token is of form posted to action
+// in session of sessId, and not expired
+func checkCSRFToken(token, sessId, action string) (err error) {
+	key, payload, err := splitFormat(token)
+	if err != nil {
+		return
+	}
+	if len(payload) != expirySize+sha256.Size {
+		err = errMalformed
+		return
+	}
+	expiryBytes, mac := payload[:expirySize], payload[expirySize:]
+	if !hmac.Equal(mac, csrfMAC(key, sessId, action, expiryBytes)) {
+		err = errInvalidSeal
+		return
+	}
+	expiry := int64(binary.BigEndian.Uint64(expiryBytes))
+	if expiry < time.Now().Unix() {
+		err = errExpired
+	}
+	return
+}
+
+func csrfMAC(key *helperKey, sessId, action string, expiry []byte) []byte {
+	hash := hmac.New(sha256.New, key.macKey)
+	// every part after its length, so that parts cannot be shifted
+	length := make([]byte, 8)
+	for _, part := range [][]byte{
+		additionalData(key, csrfLabel),
+		[]byte(sessId),
+		[]byte(action),
+		expiry,
+	} {
+		binary.BigEndian.PutUint64(length, uint64(len(part)))
+		hash.Write(length)
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// formToken is csrf token of form of the page posted to action,
+// empty if the session is not checked
+func formToken(ctx *gin.Context, action string) string {
+	sess, err := getSessionPtrFromCTX(ctx)
+	if err != nil {
+		requestLogger(ctx).Warning("no csrf token without session", "error", err)
+		return ""
+	}
+	return csrfToken(sess.UuId, action, time.Now().Add(csrfExp))
+}
+
+// CSRFMiddleware rejects every POST without a token
+// of the session and the route posted to
+func CSRFMiddleware(ctx *gin.Context) {
+	if ctx.Request.Method != http.MethodPost {
+		ctx.Next()
+		return
+	}
+
+	err := errNoSession
+	if sess, e := getSessionPtrFromCTX(ctx); e == nil {
+		err = checkCSRFToken(
+			ctx.PostForm(csrfFieldName),
+			sess.UuId,
+			ctx.FullPath(),
+		)
+	}
+	if err != nil {
+		requestLogger(ctx).Warning("csrf check failed", "error", err)
+		renderError(ctx, http.StatusForbidden, "form expired, reload the page")
+		return
+	}
+	ctx.Next()
+}
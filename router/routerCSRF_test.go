@@ -0,0 +1,55 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCSRFToken(t *testing.T) {
+	useTestKeyRing(t)
+	expiry := time.Now().Add(time.Hour)
+	// forms of two tabs at once
+	first := csrfToken("session", "/topic/post", expiry)
+	second := csrfToken("session", "/topic/post", expiry.Add(time.Second))
+
+	for _, token := range []string{first, second} {
+		err := checkCSRFToken(token, "session", "/topic/post")
+		if err != nil {
+			t.Errorf("token of the form: %v", err)
+		}
+	}
+	err := checkCSRFToken(first, "another", "/topic/post")
+	if err == nil {
+		t.Error("accepted token of another session")
+	}
+	err = checkCSRFToken(first, "session", "/topic/create")
+	if err == nil {
+		t.Error("accepted token of another action")
+	}
+	expired := csrfToken("session", "/topic/post", time.Now().Add(-time.Second))
+	err = checkCSRFToken(expired, "session", "/topic/post")
+	if err == nil {
+		t.Error("accepted expired token")
+	}
+}
+
+func FuzzCheckCSRFToken(f *testing.F) {
+	useTestKeyRing(f)
+	token := csrfToken("session", "/topic/post", time.Now().Add(time.Hour))
+	f.Add(token, "session", "/topic/post")
+	f.Add(token, "", "")
+	f.Add("", "session", "/topic/post")
+	f.Add(token[:len(token)-1], "session", "/topic/post")
+	f.Add(token+formatSeparator, "session", "/topic/post")
+	f.Add(token, "session\x00", "/topic/post")
+	f.Add("v1..", "session", "/topic/post")
+	f.Add("v1."+helper.primary.id+".", "session", "/topic/post")
+
+	f.Fuzz(func(t *testing.T, tokenVal, sessId, action string) {
+		err := checkCSRFToken(tokenVal, sessId, action)
+		if err == nil &&
+			(tokenVal != token || sessId != "session" || action != "/topic/post") {
+			t.Errorf("accepted %q for %q %q", tokenVal, sessId, action)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// cookies are
+//   v1.<key id>.<base64 of nonce and AES-GCM sealed expiry and value>
+// authenticated with their version, key id and name,
+// expiry is 8 bytes big endian unix time before the value.
+// csrf tokens share the format, see routerCSRF.go.
+
+const (
+	formatVersion   = "v1"
+	formatSeparator = "."
+	expirySize      = 8
+)
+
+var (
+	errMalformed   = errors.New("malformed value")
+	errUnknownKey  = errors.New("unknown key id")
+	errInvalidSeal = errors.New("invalid value")
+	errExpired     = errors.New("expired")
+)
+
+// strict, so that one payload has one encoding
+var rawEncoding = base64.RawURLEncoding.Strict()
+
+// splitFormat is key of parts version.keyId.payload, and payload decoded
+func splitFormat(value string) (key *helperKey, payload []byte, err error) {
+	parts := strings.Split(value, formatSeparator)
+	if len(parts) != 3 || parts[0] != formatVersion {
+		err = errMalformed
+		return
+	}
+	key, ok := helper.keys[parts[1]]
+	if !ok {
+		err = errUnknownKey
+		return
+	}
+	payload, err = rawEncoding.DecodeString(parts[2])
+	if err != nil {
+		err = errMalformed
+	}
+	return
+}
+
+func joinFormat(key *helperKey, payload []byte) string {
+	return strings.Join(
+		[]string{formatVersion, key.id, rawEncoding.EncodeToString(payload)},
+		formatSeparator,
+	)
+}
+
+// additionalData binds sealed value to its version, key and name
+func additionalData(key *helperKey, name string) []byte {
+	return []byte(strings.Join(
+		[]string{formatVersion, key.id, name},
+		formatSeparator,
+	))
+}
+
+// sealCookie encrypts value of cookie of name valid until expiry
+func sealCookie(name, value string, expiry time.Time) (sealed string, err error) {
+	key := helper.primary
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+	plain := make([]byte, expirySize, expirySize+len(value))
+	binary.BigEndian.PutUint64(plain, uint64(expiry.Unix()))
+	plain = append(plain, value...)
+
+	payload := key.aead.Seal(nonce, nonce, plain, additionalData(key, name))
+	sealed = joinFormat(key, payload)
+	return
+}
+
+// openCookie is value sealed by sealCookie for cookie of name
+func openCookie(name, sealed string) (value string, err error) {
+	key, payload, err := splitFormat(sealed)
+	if err != nil {
+		return
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(payload) < nonceSize+key.aead.Overhead()+expirySize {
+		err = errMalformed
+		return
+	}
+	plain, err := key.aead.Open(
+		nil,
+		payload[:nonceSize],
+		payload[nonceSize:],
+		additionalData(key, name),
+	)
+	if err != nil {
+		err = errInvalidSeal
+		return
+	}
+	expiry := int64(binary.BigEndian.Uint64(plain[:expirySize]))
+	if expiry < time.Now().Unix() {
+		err = errExpired
+		return
+	}
+	value = string(plain[expirySize:])
+	return
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"learning-web-chatboard3/keyring"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useTestKeyRing(t testing.TB) {
+	t.Helper()
+	ring, err := keyring.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = useKeyRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cookieContext is context of request carrying cookie of name
+func cookieContext(name, value string) *gin.Context {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx.Request.Header.Set("Cookie", name+"="+value)
+	return ctx
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	useTestKeyRing(t)
+	sealed, err := sealCookie(loginCookieLabel, "some-uuid", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := pickupCookie(cookieContext(loginCookieLabel, sealed), loginCookieLabel)
+	if err != nil || value != "some-uuid" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+	// sealed for another cookie
+	_, err = openCookie(sessionCookieLabel, sealed)
+	if err == nil {
+		t.Error("opened cookie of another name")
+	}
+	// last byte of tag flipped
+	tampered := []byte(sealed)
+	tampered[len(tampered)-1] ^= 1
+	_, err = openCookie(loginCookieLabel, string(tampered))
+	if err == nil {
+		t.Error("opened tampered cookie")
+	}
+
+	expired, err := sealCookie(loginCookieLabel, "some-uuid", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openCookie(loginCookieLabel, expired)
+	if err == nil {
+		t.Error("opened expired cookie")
+	}
+}
+
+func TestCookieAfterRotation(t *testing.T) {
+	ring, err := keyring.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = useKeyRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealCookie(loginCookieLabel, "some-uuid", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ring.Primary
+
+	// added key only validates until it is promoted
+	key, err := ring.Add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := ring.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ring.Promote(key.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = useKeyRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openCookie(loginCookieLabel, sealed)
+	if err != nil {
+		t.Errorf("cookie of old key: %v", err)
+	}
+	promoted, err := sealCookie(loginCookieLabel, "some-uuid", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// router not restarted since promotion
+	notPromoted, err := keyring.Parse(added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = useKeyRing(notPromoted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openCookie(loginCookieLabel, promoted)
+	if err != nil {
+		t.Errorf("cookie of promoted key: %v", err)
+	}
+
+	err = ring.Retire(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = useKeyRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openCookie(loginCookieLabel, sealed)
+	if err == nil {
+		t.Error("opened cookie of retired key")
+	}
+}
+
+func FuzzPickupCookie(f *testing.F) {
+	useTestKeyRing(f)
+	sealed, err := sealCookie(loginCookieLabel, "some-uuid", time.Now().Add(time.Hour))
+	if err != nil {
+		f.Fatal(err)
+	}
+	id := helper.primary.id
+	f.Add(sealed)
+	f.Add(sealed[:len(sealed)/2])
+	f.Add(sealed + formatSeparator)
+	f.Add(strings.TrimPrefix(sealed, formatVersion))
+	f.Add("")
+	f.Add(formatVersion + formatSeparator + id + formatSeparator)
+	f.Add(formatVersion + formatSeparator + id + formatSeparator + "AAAA")
+	f.Add("v0." + id + ".AAAA")
+	f.Add("||")
+	f.Add("%zz")
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		value, err := pickupCookie(cookieContext(loginCookieLabel, raw), loginCookieLabel)
+		if err == nil && raw != sealed {
+			t.Errorf("accepted %q as %q", raw, value)
+		}
+		// openCookie is fuzzed directly too, with bytes
+		// an http cookie header cannot carry to pickupCookie
+		value, err = openCookie(loginCookieLabel, raw)
+		if err == nil && raw != sealed {
+			t.Errorf("opened %q as %q", raw, value)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// backends have to answer ping within readyTimeout
+const readyTimeout time.Duration = time.Second * 3
+
+// GET /healthz
+// the process is up
+func healthzGet(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GET /readyz
+// every backend answered ping, which checks its database.
+// why a backend is not ready is logged, not answered,
+// the answer is public.
+func readyzGet(ctx *gin.Context) {
+	lg := requestLogger(ctx)
+	pingCtx, cancel := context.WithTimeout(
+		ctx.Request.Context(),
+		readyTimeout,
+	)
+	defer cancel()
+
+	backends := map[string]*rabbitrpc.RabbitClient{
+		"users":    usersClient,
+		"topics":   topicsClient,
+		"sessions": sessionsClient,
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		ready   = true
+		results = make(gin.H, len(backends))
+	)
+	for name, client := range backends {
+		wg.Add(1)
+		go func(name string, client *rabbitrpc.RabbitClient) {
+			defer wg.Done()
+			status := "ok"
+			err := ping(pingCtx, client)
+			if err != nil {
+				status = "unavailable"
+				lg.Warning("backend not ready", "backend", name, "error", err)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[name] = status
+			ready = ready && err == nil
+		}(name, client)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.JSON(status, gin.H{
+		"ready":    ready,
+		"backends": results,
+	})
+}
+
+func ping(ctx context.Context, client *rabbitrpc.RabbitClient) error {
+	return call(
+		ctx,
+		client,
+		rabbitrpc.PingFunction,
+		rabbitrpc.TypeName[rabbitrpc.Ping](),
+		&rabbitrpc.Ping{},
+		&rabbitrpc.Ping{},
+	)
+}
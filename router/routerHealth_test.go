@@ -0,0 +1,114 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testBackend serves registry on broker,
+// and returns the client of it
+func testBackend(
+	t *testing.T,
+	broker *rabbitrpc.InProcBroker,
+	name string,
+	registry *rabbitrpc.HandlerRegistry,
+) *rabbitrpc.RabbitClient {
+	var server *rabbitrpc.RabbitClient
+	server = rabbitrpc.NewRPCServerWithTransport(
+		broker,
+		name+".res",
+		name+".req",
+		name,
+		rabbitrpc.ExchangeKindDirect,
+		name+".client",
+		name+".server",
+		rabbitrpc.Options{},
+		func(raws rabbitrpc.Raws) {
+			common.ServeRequest(server, registry, logger, raws)
+		},
+	)
+	client := rabbitrpc.NewRPCClientWithTransport(
+		broker,
+		name+".req",
+		name+".res",
+		name,
+		rabbitrpc.ExchangeKindDirect,
+		name+".server",
+		name+".client",
+		rabbitrpc.Options{},
+		onResponseReceived,
+	)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+		server.Shutdown(ctx)
+	})
+	return client
+}
+
+func checkedRegistry(check func(ctx context.Context) error) *rabbitrpc.HandlerRegistry {
+	registry := rabbitrpc.NewHandlerRegistry()
+	registry.SetHealthCheck(check)
+	return registry
+}
+
+func TestReadyzHidesErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logged bytes.Buffer
+	logger = logging.New(&logged, logging.FormatLogfmt, logging.LevelWarning)
+	rabbitrpc.SetLogger(logging.New(io.Discard, logging.FormatLogfmt, logging.LevelError))
+	pendingCalls = rabbitrpc.NewPendingCalls()
+
+	broker := rabbitrpc.NewInProcBroker()
+	healthy := func(context.Context) error { return nil }
+	usersClient = testBackend(t, broker, "users", checkedRegistry(healthy))
+	sessionsClient = testBackend(t, broker, "sessions", checkedRegistry(healthy))
+	topicsClient = testBackend(t, broker, "topics", checkedRegistry(
+		func(context.Context) error {
+			return errors.New("dial tcp db.internal:5432: connection refused")
+		},
+	))
+
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	readyzGet(ctx)
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d", recorder.Code)
+	}
+	if strings.Contains(recorder.Body.String(), "db.internal") {
+		t.Errorf("answered %s", recorder.Body)
+	}
+	var res struct {
+		Ready    bool              `json:"ready"`
+		Backends map[string]string `json:"backends"`
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ready ||
+		res.Backends["users"] != "ok" ||
+		res.Backends["sessions"] != "ok" ||
+		res.Backends["topics"] != "unavailable" {
+		t.Errorf("answered %+v", res)
+	}
+	if !strings.Contains(logged.String(), "db.internal") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
@@ -1,136 +1,166 @@
-package main
+package router
 
 import (
+	"context"
+	"errors"
 	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
 	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
-	"log"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 )
 
+// relative to the directory chatboard runs in
+const (
+	staticDir     = "../router/public"
+	templatesGlob = "../router/templates/*"
+)
+
 var config *common.Configuration
-var logger *log.Logger
+var logger *logging.Logger
 var usersClient *rabbitrpc.RabbitClient
 var topicsClient *rabbitrpc.RabbitClient
 var sessionsClient *rabbitrpc.RabbitClient
-var callbackPool rabbitrpc.CallbackPool
-var callbackCh chan rabbitrpc.Raws
-var doneCh chan string
+var pendingCalls *rabbitrpc.PendingCalls
+var httpServer *http.Server
+var stopSweeper context.CancelFunc
 var validate *validator.Validate
 
-func main() {
-	var err error
-
-	// config
-	config, err = common.LoadConfig()
+// Main runs the router as a process talking to services on RabbitMQ
+func Main() {
+	cfg, err := common.LoadConfig()
 	if err != nil {
-		log.Fatalln(err.Error())
+		logging.Default().Fatal("cannot load config", "error", err)
 	}
 
-	//processor data
-	err = startHelper()
+	//log
+	lg, err := common.OpenLogger(cfg, cfg.LogFileNameRouter)
 	if err != nil {
-		log.Fatalln(err.Error())
+		logging.Default().Fatal("cannot open log", "error", err)
 	}
+	rabbitrpc.SetLogger(lg)
 
-	//log
-	logger, err = common.OpenLogger(
-		config.LogToFile,
-		config.LogFileNameThreads,
-	)
+	//metrics
+	common.ServeMetrics(cfg.MetricsAddressRouter, lg)
+
+	Run(cfg, lg, cfg.RabbitTransport())
+}
+
+// Run serves http until SIGINT or SIGTERM,
+// calling services over transport.
+// shared by Main and all-in-one.
+func Run(
+	cfg *common.Configuration,
+	lg *logging.Logger,
+	transport rabbitrpc.Transport,
+) {
+	handler := Start(cfg, lg, transport)
+
+	signals, stop := common.NotifyShutdown()
+	defer stop()
+
+	httpServer = &http.Server{
+		Addr:    config.AddressRouter,
+		Handler: handler,
+	}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("http server stopped", "error", err)
+			stop()
+		}
+	}()
+
+	<-signals.Done()
+	logger.Info("shutting down")
+	Shutdown()
+}
+
+// Start connects to services over transport and
+// returns the handler of every route, not serving it yet.
+// shared by Run and tests serving it with httptest.
+func Start(
+	cfg *common.Configuration,
+	lg *logging.Logger,
+	transport rabbitrpc.Transport,
+) http.Handler {
+	config = cfg
+	logger = lg.With("service", "router")
+
+	//processor data
+	err := startHelper()
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal("cannot start helper", "error", err)
 	}
 
 	//rabbit
-	callbackCh = make(chan rabbitrpc.Raws)
-	callbackPool = make(rabbitrpc.CallbackPool)
-	doneCh = make(chan string)
+	pendingCalls = rabbitrpc.NewPendingCalls()
 
-	usersClient = rabbitrpc.NewRPCClient(
-		rabbitrpc.DefaultRabbitURL,
+	usersClient = rabbitrpc.NewRPCClientWithTransport(
+		transport,
 		config.UsersReqQName,
 		config.UsersResQName,
 		config.UsersExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.UsersServerKey,
 		config.UsersClientKey,
-		func(raws rabbitrpc.Raws) {
-			callbackCh <- raws
-		},
+		config.RabbitOptions(),
+		onResponseReceived,
 	)
-	defer usersClient.Publisher.Done()
-	defer usersClient.Subscriber.Done()
 
-	topicsClient = rabbitrpc.NewRPCClient(
-		rabbitrpc.DefaultRabbitURL,
+	topicsClient = rabbitrpc.NewRPCClientWithTransport(
+		transport,
 		config.TopicsReqQName,
 		config.TopicsResQName,
 		config.TopicsExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.TopicsServerKey,
 		config.TopicsClientKey,
-		func(raws rabbitrpc.Raws) {
-			callbackCh <- raws
-		},
+		config.RabbitOptions(),
+		onResponseReceived,
 	)
-	defer topicsClient.Publisher.Done()
-	defer topicsClient.Subscriber.Done()
 
-	sessionsClient = rabbitrpc.NewRPCClient(
-		rabbitrpc.DefaultRabbitURL,
+	sessionsClient = rabbitrpc.NewRPCClientWithTransport(
+		transport,
 		config.SessionsReqQName,
 		config.SessionsResQName,
 		config.SessionsExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.SessionsServerKey,
 		config.SessionsClientKey,
-		func(raws rabbitrpc.Raws) {
-			callbackCh <- raws
-		},
+		config.RabbitOptions(),
+		onResponseReceived,
 	)
-	defer sessionsClient.Publisher.Done()
-	defer sessionsClient.Subscriber.Done()
 
-	go func() {
-	loop:
-		for {
-			select {
-			case <-usersClient.Publisher.CTX.Done():
-				break loop
-			case <-usersClient.Subscriber.CTX.Done():
-				break loop
-			case <-topicsClient.Publisher.CTX.Done():
-				break loop
-			case <-topicsClient.Subscriber.CTX.Done():
-				break loop
-			case <-sessionsClient.Publisher.CTX.Done():
-				break loop
-			case <-sessionsClient.Subscriber.CTX.Done():
-				break loop
-			case raws := <-callbackCh:
-				fn, ok := callbackPool[raws.CorrelationId]
-				if ok {
-					go fn(raws)
-				} else {
-					common.LogError(logger).Println("recieved unknown response")
-				}
-			case id := <-doneCh:
-				delete(callbackPool, id)
-			}
-		}
-	}()
+	if !common.IsEmpty(config.RPCContentType) {
+		usersClient.ContentType = config.RPCContentType
+		topicsClient.ContentType = config.RPCContentType
+		sessionsClient.ContentType = config.RPCContentType
+	}
+
+	var sweeperCTX context.Context
+	sweeperCTX, stopSweeper = context.WithCancel(context.Background())
+	go pendingCalls.RunSweeper(sweeperCTX, pendingSweepInterval)
 
 	// validator
 	validate = validator.New()
 
 	//gin
-	webEngine := gin.Default()
+	webEngine := gin.New()
+	webEngine.Use(
+		AccessLogMiddleware,
+		gin.Recovery(),
+		TraceMiddleware,
+		MetricsMiddleware,
+	)
+	webEngine.GET("/healthz", healthzGet)
+	webEngine.GET("/readyz", readyzGet)
 	// setup templates
-	webEngine.Static("/static", "./public")
+	webEngine.Static("/static", staticDir)
 	webEngine.Delims("{{", "}}")
-	webEngine.LoadHTMLGlob("./templates/*")
+	webEngine.LoadHTMLGlob(templatesGlob)
 	//setup routes
 	webEngine.GET(
 		"/",
@@ -152,17 +182,10 @@ func main() {
 		SetCommonHeadersMiddleware,
 		SessionCheckMiddleware,
 		LoggedInCheckMiddleware,
+		CSRFMiddleware,
 	)
-	usersRoute.GET(
-		"/login",
-		GenerateSessionStateMiddleware,
-		loginGet,
-	)
-	usersRoute.GET(
-		"/signup",
-		GenerateSessionStateMiddleware,
-		signupGet,
-	)
+	usersRoute.GET("/login", loginGet)
+	usersRoute.GET("/signup", signupGet)
 	usersRoute.GET("/logout", logoutGet)
 	usersRoute.POST("/signup-account", signupPost)
 	usersRoute.POST("/authenticate", authenticatePost)
@@ -172,19 +195,66 @@ func main() {
 		SetCommonHeadersMiddleware,
 		SessionCheckMiddleware,
 		LoggedInCheckMiddleware,
+		CSRFMiddleware,
 	)
-	threadsRoute.GET(
-		"/read",
-		GenerateLoginStateMiddleware,
-		topicGet,
-	)
-	threadsRoute.GET(
-		"/new",
-		GenerateLoginStateMiddleware,
-		newTopicGet,
-	)
+	threadsRoute.GET("/read", topicGet)
+	threadsRoute.GET("/new", newTopicGet)
 	threadsRoute.POST("/create", newTopicPost)
 	threadsRoute.POST("/post", newReplyPost)
 
-	webEngine.Run(config.AddressRouter)
+	setupAPI(webEngine)
+	webEngine.NoRoute(apiNoRoute)
+	return webEngine
+}
+
+// Shutdown stops accepting connections if serving, waits for handlers
+// and for the responses they wait for, then closes the clients
+func Shutdown() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
+	defer stopSweeper()
+
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+		if err != nil {
+			logger.Warning("http shutdown incomplete", "error", err)
+		}
+	}
+	err = pendingCalls.Drain(ctx)
+	if err != nil {
+		logger.Warning(
+			"calls left pending",
+			"count", pendingCalls.Len(),
+			"error", err,
+		)
+	}
+	for _, client := range []*rabbitrpc.RabbitClient{
+		usersClient,
+		topicsClient,
+		sessionsClient,
+	} {
+		err = client.Shutdown(ctx)
+		if err != nil {
+			logger.Warning(
+				"client shutdown incomplete",
+				"exchange", client.ExchangeName,
+				"error", err,
+			)
+		}
+	}
+}
+
+func onResponseReceived(raws rabbitrpc.Raws) {
+	fn, ok := pendingCalls.Resolve(raws)
+	if !ok {
+		logger.With(rabbitrpc.RawsFields(&raws)...).Error(
+			"received unknown response",
+		)
+		return
+	}
+	go fn(raws)
 }
@@ -1,21 +1,89 @@
-package main
+package router
 
 import (
 	"errors"
 	"learning-web-chatboard3/common"
-	"net/http"
-	"strings"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
-	loggedInLabel   = "logged-in"
-	loginPtrLabel   = "login-ptr"
-	sessionPtrLabel = "session-ptr"
-	stateLabel      = "state"
+	loggedInLabel     = "logged-in"
+	loginPtrLabel     = "login-ptr"
+	sessionPtrLabel   = "session-ptr"
+	traceContextLabel = "trace-context"
 )
 
+const requestIdHeader = "X-Request-Id"
+
+// TraceMiddleware continues the trace of the caller,
+// or starts a new one, and puts it in the request context.
+// the trace id is answered as request id.
+func TraceMiddleware(ctx *gin.Context) {
+	trace, ok := rabbitrpc.ParseTraceParent(
+		ctx.GetHeader(rabbitrpc.HeaderTraceParent),
+	)
+	if ok {
+		trace = trace.Child()
+	} else {
+		trace = rabbitrpc.NewTraceContext()
+	}
+	ctx.Request = ctx.Request.WithContext(
+		rabbitrpc.WithTrace(ctx.Request.Context(), trace),
+	)
+	ctx.Set(traceContextLabel, trace)
+	ctx.Header(requestIdHeader, trace.TraceId)
+	ctx.Next()
+}
+
+var httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "http_request_duration_seconds",
+	Help: "Time spent answering http requests by route and status.",
+}, []string{"method", "route", "status"})
+
+// MetricsMiddleware observes latency of every route.
+// unmatched paths share one label to keep cardinality low.
+func MetricsMiddleware(ctx *gin.Context) {
+	started := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if len(route) == 0 {
+		route = "unmatched"
+	}
+	httpRequestDuration.WithLabelValues(
+		ctx.Request.Method,
+		route,
+		strconv.Itoa(ctx.Writer.Status()),
+	).Observe(time.Since(started).Seconds())
+}
+
+// AccessLogMiddleware logs every request after it is answered,
+// in place of gin's own logger
+func AccessLogMiddleware(ctx *gin.Context) {
+	started := time.Now()
+	path := ctx.Request.URL.Path
+	ctx.Next()
+
+	keyvals := []interface{}{
+		"method", ctx.Request.Method,
+		"path", path,
+		"status", ctx.Writer.Status(),
+		"latency", time.Since(started),
+		"client_ip", ctx.ClientIP(),
+	}
+	if errs := ctx.Errors.ByType(gin.ErrorTypePrivate).String(); len(errs) > 0 {
+		keyvals = append(keyvals, "errors", errs)
+	}
+	requestLogger(ctx).Info("request", keyvals...)
+}
+
 func SetCommonHeadersMiddleware(ctx *gin.Context) {
 	ctx.Header("Cache-Control", "no-store")
 	ctx.Header("X-Frame-Options", "DENY")
@@ -26,80 +94,55 @@ func SetCommonHeadersMiddleware(ctx *gin.Context) {
 func SessionCheckMiddleware(ctx *gin.Context) {
 	err := checkSession(ctx)
 	if err != nil {
-		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln(err.Error())
-		} else {
-			common.LogError(logger).Printf("!!MIDDLEWARE ERROR!! %s\n", err.Error())
-			return
-		}
+		handleCallError(err, ctx)
+		return
 	}
 	ctx.Next()
 }
 
 func LoggedInCheckMiddleware(ctx *gin.Context) {
 	err := checkLoggedIn(ctx)
-	if err != nil {
-		common.LogWarning(logger).Println(err.Error())
-	}
-	ctx.Set(loggedInLabel, err == nil)
-	ctx.Next()
-}
-
-func GenerateLoginStateMiddleware(ctx *gin.Context) {
-	if !confirmLoggedIn(ctx) {
+	if errors.Is(err, errRPCTimeout) {
+		handleCallError(err, ctx)
 		return
 	}
-
-	state, err := generateLoginState(ctx)
 	if err != nil {
-		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln(err.Error())
-		} else {
-			common.LogError(logger).Printf("!!MIDDLEWARE NOTWORKING!! %s\n", err.Error())
-		}
+		requestLogger(ctx).Warning("not logged in", "error", err)
 	}
-	ctx.Set(stateLabel, state)
+	ctx.Set(loggedInLabel, err == nil)
 	ctx.Next()
 }
 
-func GenerateSessionStateMiddleware(ctx *gin.Context) {
-	state, err := generateSessionState(ctx)
-	if err != nil {
-		// safety for invalid cookie
-		if strings.Compare(err.Error(), "invalid cookie") == 0 {
-			ctx.Redirect(http.StatusFound, "/")
-			return
-		}
+// belowes are related utils ///////////////////////////////////////
 
-		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln(err.Error())
-		} else {
-			common.LogError(logger).Printf("!!MIDDLEWARE NOTWORKING!! %s\n", err.Error())
+// requestLogger puts the trace and the user of the request
+// on log lines
+func requestLogger(ctx *gin.Context) *logging.Logger {
+	lg := logger.With(rabbitrpc.TraceFields(ctx.Request.Context())...)
+	if val, ok := ctx.Get(loginPtrLabel); ok {
+		if login, ok := val.(*common.Login); ok {
+			lg = lg.With("user_id", login.UserId)
 		}
 	}
-
-	ctx.Set(stateLabel, state)
-	ctx.Next()
+	return lg
 }
 
-// belowes are related utils ///////////////////////////////////////
-
 func confirmLoggedIn(ctx *gin.Context) (isLoggedIn bool) {
 	loggedInVal, ok := ctx.Get(loggedInLabel)
 	if !ok {
 		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln("logged-in not stored")
+			requestLogger(ctx).Fatal("logged-in not stored")
 		} else {
-			common.LogError(logger).Println("!!MIDDLEWARE NOT WORKING!! logged-in not stored")
+			requestLogger(ctx).Error("logged-in not stored")
 		}
 		return
 	}
 	isLoggedIn, ok = loggedInVal.(bool)
 	if !ok {
 		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln("logged-in is not boolean")
+			requestLogger(ctx).Fatal("logged-in is not boolean")
 		} else {
-			common.LogError(logger).Println("!!MIDDLEWARE BROKEN!! logged-in is not boolean")
+			requestLogger(ctx).Error("logged-in is not boolean")
 		}
 	}
 	return
@@ -113,7 +156,7 @@ func getLoginPtrFromCTX(ctx *gin.Context) (ptr *common.Login, err error) {
 	}
 	if ptr, ok = val.(*common.Login); !ok {
 		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln("login-ptr is not *Login")
+			requestLogger(ctx).Fatal("login-ptr is not *Login")
 		}
 		err = errors.New("!!MIDDLEWARE BROKEN!! login-ptr is not *Login")
 	}
@@ -128,25 +171,9 @@ func getSessionPtrFromCTX(ctx *gin.Context) (ptr *common.Session, err error) {
 	}
 	if ptr, ok = val.(*common.Session); !ok {
 		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln("session-ptr is not *Session")
+			requestLogger(ctx).Fatal("session-ptr is not *Session")
 		}
 		err = errors.New("!!MIDDLEWARE BROKEN!! session-ptr is not *Session")
 	}
 	return
 }
-
-func getStateFromCTX(ctx *gin.Context) (state string) {
-	val, ok := ctx.Get(stateLabel)
-	if !ok {
-		common.LogWarning(logger).Println("state not generated yet")
-		return
-	}
-	if state, ok = val.(string); !ok {
-		if gin.IsDebugging() {
-			common.LogError(logger).Fatalln("state is not string")
-		} else {
-			common.LogError(logger).Println("!!MIDDLEWARE BROKEN!! state is not string")
-		}
-	}
-	return
-}
@@ -0,0 +1,49 @@
+package router
+
+import (
+	"context"
+	"io"
+	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSessionCheckUnavailable(t *testing.T) {
+	// failed check used to be fatal in debug mode
+	gin.SetMode(gin.DebugMode)
+	defer gin.SetMode(gin.TestMode)
+	useTestKeyRing(t)
+	logger = logging.New(io.Discard, logging.FormatLogfmt, logging.LevelError)
+	rabbitrpc.SetLogger(logger)
+	pendingCalls = rabbitrpc.NewPendingCalls()
+
+	registry := rabbitrpc.NewHandlerRegistry()
+	rabbitrpc.Register(registry, "createSession", func(
+		context.Context,
+		*common.Session,
+	) (*common.Session, error) {
+		return nil, rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeUnavailable,
+			"database is down",
+		)
+	})
+	sessionsClient = testBackend(t, rabbitrpc.NewInProcBroker(), "sessions", registry)
+
+	recorder := httptest.NewRecorder()
+	_, engine := gin.CreateTestContext(recorder)
+	engine.LoadHTMLGlob(templatesGlob)
+	engine.Use(SessionCheckMiddleware)
+	engine.GET("/", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "passed")
+	})
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, %q", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// passwords are stored encoded with their algorithm and parameters,
+//   $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+// or, for users signed up before argon2id,
+//   $sha256$<salt>$<hash>
+// which is upgraded to argon2id on their next login.
+
+const (
+	argon2idPrefix = "$argon2id$"
+	sha256Prefix   = "$sha256$"
+
+	argon2Time    uint32 = 1
+	argon2Memory  uint32 = 64 * 1024
+	argon2Threads uint8  = 4
+	argon2KeySize uint32 = 32
+	argon2Format         = "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s"
+
+	// legacy salted sha256
+	numStretching int = 10000
+)
+
+var errUnknownHash = errors.New("unknown password hash")
+
+var b64 = base64.RawStdEncoding
+
+// hashPassword encodes pw with argon2id and a new salt
+func hashPassword(pw string) (encoded string, err error) {
+	salt := make([]byte, pwSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	hash := argon2.IDKey(
+		[]byte(pw),
+		salt,
+		argon2Time,
+		argon2Memory,
+		argon2Threads,
+		argon2KeySize,
+	)
+	encoded = fmt.Sprintf(
+		argon2Format,
+		argon2.Version,
+		argon2Memory,
+		argon2Time,
+		argon2Threads,
+		b64.EncodeToString(salt),
+		b64.EncodeToString(hash),
+	)
+	return
+}
+
+// verifyPassword reports whether pw matches encoded,
+// and whether encoded should be replaced by hashPassword(pw)
+func verifyPassword(pw, encoded string) (ok bool, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return verifyArgon2id(pw, encoded)
+	case strings.HasPrefix(encoded, sha256Prefix):
+		ok, err = verifySHA256(pw, encoded)
+		return ok, ok, err
+	default:
+		return false, false, errUnknownHash
+	}
+}
+
+func verifyArgon2id(pw, encoded string) (ok bool, rehash bool, err error) {
+	var version int
+	var memory, time uint32
+	var threads uint8
+	var saltB64, hashB64 string
+	// salt and hash are the last two fields
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 {
+		err = errUnknownHash
+		return
+	}
+	_, err = fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return
+	}
+	saltB64, hashB64 = fields[4], fields[5]
+	salt, err := b64.DecodeString(saltB64)
+	if err != nil {
+		return
+	}
+	hash, err := b64.DecodeString(hashB64)
+	if err != nil {
+		return
+	}
+	if version != argon2.Version || len(hash) == 0 {
+		err = errUnknownHash
+		return
+	}
+
+	computed := argon2.IDKey(
+		[]byte(pw),
+		salt,
+		time,
+		memory,
+		threads,
+		uint32(len(hash)),
+	)
+	ok = subtle.ConstantTimeCompare(hash, computed) == 1
+	rehash = ok && (memory != argon2Memory ||
+		time != argon2Time ||
+		threads != argon2Threads ||
+		uint32(len(hash)) != argon2KeySize)
+	return
+}
+
+func verifySHA256(pw, encoded string) (ok bool, err error) {
+	saltAndHash := strings.TrimPrefix(encoded, sha256Prefix)
+	i := strings.LastIndex(saltAndHash, "$")
+	if i < 0 {
+		err = errUnknownHash
+		return
+	}
+	salt, hash := saltAndHash[:i], saltAndHash[i+1:]
+	computed := legacyHash(fmt.Sprint(salt, pw))
+	ok = subtle.ConstantTimeCompare([]byte(hash), []byte(computed)) == 1
+	return
+}
+
+// legacyHash is how passwords were hashed before argon2id,
+// kept to verify them once more
+func legacyHash(plainText string) (hashed string) {
+	asBytes := []byte(plainText)
+	hash := sha256.New()
+	for i := 0; i < numStretching; i++ {
+		asBytes = hash.Sum(asBytes)
+	}
+
+	hashed = fmt.Sprintf("%x", asBytes)
+	return
+}
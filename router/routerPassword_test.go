@@ -0,0 +1,82 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestVerifyLegacyPassword(t *testing.T) {
+	// the baseline stored legacyHash(salt + pw) next to its salt,
+	// joined by the 0003_password_encoding migration
+	salt := "0123456789abcdef"
+	encoded := sha256Prefix + salt + "$" + legacyHash(salt+"secret")
+
+	ok, rehash, err := verifyPassword("secret", encoded)
+	if err != nil || !ok || !rehash {
+		t.Errorf("legacy password: ok %t, rehash %t, %v", ok, rehash, err)
+	}
+	ok, rehash, err = verifyPassword("wrong", encoded)
+	if err != nil || ok || rehash {
+		t.Errorf("wrong legacy password: ok %t, rehash %t, %v", ok, rehash, err)
+	}
+}
+
+func TestVerifyArgon2idPassword(t *testing.T) {
+	encoded, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, rehash, err := verifyPassword("secret", encoded)
+	if err != nil || !ok || rehash {
+		t.Errorf("password: ok %t, rehash %t, %v", ok, rehash, err)
+	}
+	ok, _, err = verifyPassword("wrong", encoded)
+	if err != nil || ok {
+		t.Errorf("wrong password: ok %t, %v", ok, err)
+	}
+
+	// hashed with older parameters
+	salt := []byte("0123456789abcdef")
+	older := fmt.Sprintf(
+		argon2Format,
+		argon2.Version,
+		argon2Memory/2,
+		argon2Time,
+		argon2Threads,
+		b64.EncodeToString(salt),
+		b64.EncodeToString(argon2.IDKey(
+			[]byte("secret"),
+			salt,
+			argon2Time,
+			argon2Memory/2,
+			argon2Threads,
+			argon2KeySize,
+		)),
+	)
+	ok, rehash, err = verifyPassword("secret", older)
+	if err != nil || !ok || !rehash {
+		t.Errorf("older parameters: ok %t, rehash %t, %v", ok, rehash, err)
+	}
+}
+
+func TestVerifyUnknownPassword(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"plain",
+		"$bcrypt$salt$hash",
+		"$sha256$nosalt",
+		"$argon2id$v=19$m=65536,t=1,p=4$salt",
+	} {
+		ok, _, err := verifyPassword("secret", encoded)
+		if ok || err == nil {
+			t.Errorf("%q: ok %t, %v", encoded, ok, err)
+		}
+	}
+	_, _, err := verifyPassword("secret", "plain")
+	if !errors.Is(err, errUnknownHash) {
+		t.Errorf("plain: %v", err)
+	}
+}
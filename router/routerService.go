@@ -1,4 +1,4 @@
-package main
+package router
 
 import (
 	"errors"
@@ -7,7 +7,6 @@ import (
 	"learning-web-chatboard3/common"
 	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
 	"net/http"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -51,17 +50,54 @@ const (
 </div>`
 )
 
-func handleErrorInternal(
-	loggerErrorMsg string,
-	ctx *gin.Context,
-	redirect bool,
-) {
-	common.LogError(logger).Println(loggerErrorMsg)
-	if redirect {
-		errorRedirect(ctx, "internal error")
+// handleCallError answers in place with the status
+// and the message for the code of err
+func handleCallError(err error, ctx *gin.Context) {
+	status, msg := httpStatusOf(err)
+	if status >= http.StatusInternalServerError {
+		requestLogger(ctx).Error("call failed", "error", err)
+	} else {
+		requestLogger(ctx).Warning("call failed", "error", err)
+	}
+	renderError(ctx, status, msg)
+}
+
+func httpStatusOf(err error) (status int, msg string) {
+	if errors.Is(err, errRPCTimeout) {
+		return http.StatusGatewayTimeout, "service did not respond in time"
+	}
+
+	switch rabbitrpc.CodeOf(err) {
+	case rabbitrpc.ErrorCodeNotFound:
+		return http.StatusNotFound, "not found"
+	case rabbitrpc.ErrorCodeValidation:
+		return http.StatusBadRequest, "invalid input"
+	case rabbitrpc.ErrorCodeConflict:
+		return http.StatusConflict, "already exists"
+	case rabbitrpc.ErrorCodeUnauthorized:
+		return http.StatusUnauthorized, "authentication failed"
+	case rabbitrpc.ErrorCodeUnavailable:
+		return http.StatusServiceUnavailable, "service unavailable"
+	default:
+		return http.StatusInternalServerError, "internal error"
 	}
 }
 
+func renderError(ctx *gin.Context, status int, msg string) {
+	loggedIn, _ := ctx.Get(loggedInLabel)
+	isLoggedIn, _ := loggedIn.(bool)
+	navbar, _ := getHTMLElemntInternal(isLoggedIn)
+	ctx.HTML(
+		status,
+		"error.html",
+		gin.H{
+			"navbar": navbar,
+			"msg":    msg,
+		},
+	)
+	ctx.Abort()
+}
+
 func getHTMLElemntInternal(isLoggedin bool) (template.HTML, template.HTML) {
 	if isLoggedin {
 		return privateNavbar, replyForm
@@ -73,7 +109,8 @@ func getHTMLElemntInternal(isLoggedin bool) (template.HTML, template.HTML) {
 func indexGet(ctx *gin.Context) {
 	topics, err := indexGetInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleCallError(err, ctx)
+		return
 	}
 	navbar, _ := getHTMLElemntInternal(confirmLoggedIn(ctx))
 	ctx.HTML(
@@ -87,33 +124,17 @@ func indexGet(ctx *gin.Context) {
 }
 
 func indexGetInternal(ctx *gin.Context) (topics []common.Topic, err error) {
-	err = sendRequestAndWait(
+	err = call(
+		ctx.Request.Context(),
 		topicsClient,
 		"readTopics",
 		"Topic",
 		&common.Topic{},
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &topics)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+		&topics,
 	)
 	return
 }
 
-func errorRedirect(ctx *gin.Context, msg string) {
-	ctx.Redirect(
-		http.StatusFound,
-		fmt.Sprintf(
-			"%s%s",
-			"/error?msg=",
-			msg,
-		),
-	)
-}
-
 func errorGet(ctx *gin.Context) {
 	errMsg := ctx.Query("msg")
 	err := validate.Var(errMsg, "lowercase")
@@ -122,7 +143,7 @@ func errorGet(ctx *gin.Context) {
 	}
 	navbar, _ := getHTMLElemntInternal(confirmLoggedIn(ctx))
 	ctx.HTML(
-		http.StatusFound,
+		http.StatusOK,
 		"error.html",
 		gin.H{
 			"navbar": navbar,
@@ -132,23 +153,21 @@ func errorGet(ctx *gin.Context) {
 }
 
 func loginGet(ctx *gin.Context) {
-	state := getStateFromCTX(ctx)
 	ctx.HTML(
 		http.StatusOK,
 		"login.html",
 		gin.H{
-			"state": state,
+			"csrfToken": formToken(ctx, "/user/authenticate"),
 		},
 	)
 }
 
 func signupGet(ctx *gin.Context) {
-	state := getStateFromCTX(ctx)
 	ctx.HTML(
 		http.StatusOK,
 		"signup.html",
 		gin.H{
-			"state": state,
+			"csrfToken": formToken(ctx, "/user/signup-account"),
 		},
 	)
 }
@@ -157,7 +176,7 @@ func logoutGet(ctx *gin.Context) {
 	if confirmLoggedIn(ctx) {
 		err := logoutGetInternal(ctx)
 		if err != nil {
-			handleErrorInternal(err.Error(), ctx, true)
+			handleCallError(err, ctx)
 			return
 		}
 	}
@@ -169,18 +188,20 @@ func logoutGetInternal(ctx *gin.Context) (err error) {
 	if err != nil {
 		return
 	}
+	err = logout(ctx, login)
+	return
+}
 
-	err = sendRequest(
+// logout deletes login, waiting for it
+// so that it is no longer valid when answered
+func logout(ctx *gin.Context, login *common.Login) (err error) {
+	err = call(
+		ctx.Request.Context(),
 		usersClient,
 		"deleteLogin",
 		"Login",
 		login,
-		func(raws rabbitrpc.Raws) {
-			e := extract(&raws, &common.SimpleMessage{})
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-		},
+		&common.SimpleMessage{},
 	)
 	return
 }
@@ -188,43 +209,47 @@ func logoutGetInternal(ctx *gin.Context) (err error) {
 func signupPost(ctx *gin.Context) {
 	err := signupPostInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleCallError(err, ctx)
 		return
 	}
 	ctx.Redirect(http.StatusMovedPermanently, "/user/login")
 }
 
 func signupPostInternal(ctx *gin.Context) (err error) {
-	_, err = sessionStateCheckProcess(ctx)
-	if err != nil {
+	_, err = signup(
+		ctx,
+		ctx.PostForm("name"),
+		ctx.PostForm("email"),
+		ctx.PostForm("password"),
+	)
+	return
+}
+
+// signup creates user of name, email and password
+func signup(ctx *gin.Context, name, email, pw string) (user *common.User, err error) {
+	// hashed, an empty password is no longer empty for users
+	if common.IsEmpty(pw) {
+		err = rabbitrpc.NewError(rabbitrpc.ErrorCodeValidation, "empty password")
 		return
 	}
-
-	var salt string
-	salt, err = generateString(pwSaltSize)
+	hashed, err := hashPassword(pw)
 	if err != nil {
 		return
 	}
-	pw := processPassword(ctx.PostForm("password"), salt)
 	newUser := common.User{
-		Name:     ctx.PostForm("name"),
-		Email:    ctx.PostForm("email"),
-		Password: pw,
-		Salt:     salt,
+		Name:     name,
+		Email:    email,
+		Password: hashed,
 	}
 
-	err = sendRequest(
+	user = &common.User{}
+	err = call(
+		ctx.Request.Context(),
 		usersClient,
 		"createUser",
 		"User",
 		&newUser,
-		func(raws rabbitrpc.Raws) {
-			user := &common.User{}
-			e := extract(&raws, user)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-		},
+		user,
 	)
 	return
 }
@@ -232,101 +257,139 @@ func signupPostInternal(ctx *gin.Context) (err error) {
 func authenticatePost(ctx *gin.Context) {
 	err := authenticatePostInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleCallError(err, ctx)
 		return
 	}
 	ctx.Redirect(http.StatusMovedPermanently, "/")
 }
 
 func authenticatePostInternal(ctx *gin.Context) (err error) {
-	_, err = sessionStateCheckProcess(ctx)
+	login, err := authenticate(
+		ctx,
+		ctx.PostForm("email"),
+		ctx.PostForm("password"),
+		common.LoginKindBrowser,
+	)
 	if err != nil {
 		return
 	}
 
-	email := ctx.PostForm("email")
+	// actual login starts here
+	err = storeLoginCookie(ctx, login.UuId)
+	return
+}
+
+// authenticate starts a new login of kind of user of email and pw,
+// every other login of the user of the same kind ends
+func authenticate(
+	ctx *gin.Context,
+	email, pw, kind string,
+) (login *common.Login, err error) {
 	err = validate.Var(email, "email")
 	if err != nil {
+		err = rabbitrpc.NewError(rabbitrpc.ErrorCodeValidation, err.Error())
 		return
 	}
 
 	authUser := common.User{
 		Email: email,
 	}
-	err = sendRequestAndWait(
+	err = call(
+		ctx.Request.Context(),
 		usersClient,
 		"readUser",
 		"User",
 		&authUser,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &authUser)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+		&authUser,
 	)
+	// not telling which of email or password is wrong
+	if rabbitrpc.CodeOf(err) == rabbitrpc.ErrorCodeNotFound {
+		err = rabbitrpc.NewError(rabbitrpc.ErrorCodeUnauthorized, err.Error())
+	}
 	if err != nil {
 		return
 	}
 
-	pw := processPassword(ctx.PostForm("password"), authUser.Salt)
-	if strings.Compare(authUser.Password, pw) != 0 {
-		err = errors.New("password mismatch")
+	ok, rehash, err := verifyPassword(pw, authUser.Password)
+	if err != nil {
 		return
 	}
+	if !ok {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeUnauthorized,
+			"password mismatch",
+		)
+		return
+	}
+	if rehash {
+		upgradePassword(ctx, &authUser, pw)
+	}
 
-	// delete invalid login data in db first
+	// delete invalid login data in db first,
+	// waiting for it so that the new login is not deleted
 	delSess := common.Login{
 		UserName: authUser.Name,
 		UserId:   authUser.Id,
+		Kind:     kind,
 	}
-	err = sendRequest(
+	err = call(
+		ctx.Request.Context(),
 		usersClient,
 		"deleteLogin",
 		"Login",
 		&delSess,
-		func(raws rabbitrpc.Raws) {
-			e := extract(&raws, &common.SimpleMessage{})
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-		},
+		&common.SimpleMessage{},
 	)
+	if err != nil {
+		return
+	}
 
 	// start new session
-	login := common.Login{}
-	err = sendRequestAndWait(
+	login = &common.Login{}
+	err = call(
+		ctx.Request.Context(),
 		usersClient,
 		"createLogin",
-		"User",
-		&authUser,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &login)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
+		"Login",
+		&common.Login{
+			UserName: authUser.Name,
+			UserId:   authUser.Id,
+			Kind:     kind,
 		},
+		login,
 	)
+	return
+}
+
+// upgradePassword stores pw hashed in the current way.
+// login goes on even if it fails, the old hash still works.
+func upgradePassword(ctx *gin.Context, user *common.User, pw string) {
+	encoded, err := hashPassword(pw)
+	if err == nil {
+		err = call(
+			ctx.Request.Context(),
+			usersClient,
+			"updatePassword",
+			"User",
+			&common.User{Id: user.Id, Password: encoded},
+			&common.User{},
+		)
+	}
 	if err != nil {
+		requestLogger(ctx).Warning("cannot upgrade password hash", "error", err)
 		return
 	}
-
-	// actual login starts here
-	err = storeLoginCookie(ctx, login.UuId)
-	return
+	requestLogger(ctx).Info("upgraded password hash", "user_id", user.Id)
 }
 
 func topicGet(ctx *gin.Context) {
 	topic, replies, err := topicGetInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleCallError(err, ctx)
 		return
 	}
 
 	navbar, replyForm := getHTMLElemntInternal(confirmLoggedIn(ctx))
-	state := getStateFromCTX(ctx)
 
 	ctx.HTML(
 		http.StatusOK,
@@ -336,82 +399,66 @@ func topicGet(ctx *gin.Context) {
 			"topic":     topic,
 			"replyForm": replyForm,
 			"replies":   replies,
-			"state":     state,
+			"csrfToken": formToken(ctx, "/topic/post"),
 		},
 	)
 }
 
 func topicGetInternal(ctx *gin.Context,
 ) (topic *common.Topic, replies []common.Reply, err error) {
-	base64_uuid := ctx.Query("id")
-	bytes, err := decode(base64_uuid)
-	if err != nil {
-		return
-	}
-
-	uuid := string(bytes)
-	err = validate.Var(uuid, "uuid4")
+	topic, err = readTopicOf(ctx, ctx.Query("id"))
 	if err != nil {
 		return
 	}
+	replies, err = readRepliesOf(ctx, topic)
+	return
+}
 
-	topic = &common.Topic{UuId: uuid}
-	err = sendRequestAndWait(
+func readRepliesOf(ctx *gin.Context, topic *common.Topic) (replies []common.Reply, err error) {
+	err = call(
+		ctx.Request.Context(),
 		topicsClient,
-		"readATopic",
+		"readRepliesInTopic",
 		"Topic",
 		topic,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, topic)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+		&replies,
 	)
+	return
+}
+
+// readTopicOf is topic of public id, as in /topic/read?id=
+func readTopicOf(ctx *gin.Context, publicId string) (topic *common.Topic, err error) {
+	bytes, err := decode(publicId)
+	if err == nil {
+		err = validate.Var(string(bytes), "uuid4")
+	}
 	if err != nil {
+		err = rabbitrpc.NewError(rabbitrpc.ErrorCodeValidation, "invalid topic id")
 		return
 	}
 
-	err = sendRequestAndWait(
+	topic = &common.Topic{UuId: string(bytes)}
+	err = call(
+		ctx.Request.Context(),
 		topicsClient,
-		"readRepliesInTopic",
+		"readATopic",
 		"Topic",
 		topic,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &replies)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+		topic,
 	)
-	if err != nil {
-		return
-	}
-
-	// store info into session
-	sess, err := getSessionPtrFromCTX(ctx)
-	if err != nil {
-		return
-	}
-	sess.TopicId = topic.Id
-	sess.TopicUuId = topic.UuId
-	err = requestSessionUpdate(sess, ctx)
 	return
 }
 
 func newTopicGet(ctx *gin.Context) {
 	loggedin := confirmLoggedIn(ctx)
 	navbar, _ := getHTMLElemntInternal(loggedin)
-	state := getStateFromCTX(ctx)
 	if loggedin {
 		ctx.HTML(
 			http.StatusOK,
 			"newtopic.html",
 			gin.H{
-				"navbar": navbar,
-				"state":  state,
+				"navbar":    navbar,
+				"csrfToken": formToken(ctx, "/topic/create"),
 			},
 		)
 	} else {
@@ -427,7 +474,7 @@ func newTopicPost(ctx *gin.Context) {
 
 	err := newTopicPostInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleCallError(err, ctx)
 		return
 	}
 
@@ -435,28 +482,32 @@ func newTopicPost(ctx *gin.Context) {
 }
 
 func newTopicPostInternal(ctx *gin.Context) (err error) {
-	login, err := loginStateCheckProcess(ctx)
+	login, err := getLoginPtrFromCTX(ctx)
 	if err != nil {
 		return
 	}
+	_, err = createTopic(ctx, login, ctx.PostForm("topic"))
+	return
+}
 
-	topic := common.Topic{
-		Topic:  ctx.PostForm("topic"),
+// createTopic creates topic of text owned by user of login
+func createTopic(
+	ctx *gin.Context,
+	login *common.Login,
+	text string,
+) (topic *common.Topic, err error) {
+	topic = &common.Topic{
+		Topic:  text,
 		Owner:  login.UserName,
 		UserId: login.UserId,
 	}
-	err = sendRequestAndWait(
+	err = call(
+		ctx.Request.Context(),
 		topicsClient,
 		"createTopic",
 		"Topic",
-		&topic,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &topic)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+		topic,
+		topic,
 	)
 	return
 }
@@ -469,7 +520,7 @@ func newReplyPost(ctx *gin.Context) {
 
 	topiUuId, err := newReplyPostInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleCallError(err, ctx)
 		return
 	}
 	encoded := encode([]byte(topiUuId))
@@ -477,50 +528,59 @@ func newReplyPost(ctx *gin.Context) {
 }
 
 func newReplyPostInternal(ctx *gin.Context) (topiUuId string, err error) {
-	login, err := loginStateCheckProcess(ctx)
+	login, err := getLoginPtrFromCTX(ctx)
 	if err != nil {
 		return
 	}
 
-	// pick up info from session
-	sess, err := getSessionPtrFromCTX(ctx)
-	topiId := sess.TopicId
-	topiUuId = sess.TopicUuId
-
-	body := ctx.PostForm("body")
+	// topic of the form, not of the page opened last
+	topic, err := readTopicOf(ctx, ctx.PostForm("topic_id"))
+	if err != nil {
+		return
+	}
+	_, err = createReply(ctx, login, topic, ctx.PostForm("body"))
+	topiUuId = topic.UuId
+	return
+}
 
-	reply := common.Reply{
+// createReply creates reply of body to topic by user of login,
+// replies of topic are counted after answered
+func createReply(
+	ctx *gin.Context,
+	login *common.Login,
+	topic *common.Topic,
+	body string,
+) (reply *common.Reply, err error) {
+	reply = &common.Reply{
 		Body:        body,
 		Contributor: login.UserName,
 		UserId:      login.UserId,
-		TopicId:     topiId,
+		TopicId:     topic.Id,
 	}
-	err = sendRequest(
+	err = call(
+		ctx.Request.Context(),
 		topicsClient,
 		"createReply",
 		"Reply",
-		&reply,
-		func(raws rabbitrpc.Raws) {
-			e := extract(&raws, &reply)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-		},
+		reply,
+		reply,
 	)
 	if err != nil {
 		return
 	}
 
-	topic := common.Topic{UuId: topiUuId}
+	// taken now, ctx is gone when the response arrives
+	lg := requestLogger(ctx)
 	err = sendRequest(
+		ctx.Request.Context(),
 		topicsClient,
 		"incrementTopic",
 		"Topic",
-		&topic,
+		&common.Topic{UuId: topic.UuId},
 		func(raws rabbitrpc.Raws) {
-			e := extract(&raws, &topic)
+			e := extract(&raws, &common.Topic{})
 			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
+				lg.Error("cannot increment replies", "error", e)
 			}
 		},
 	)
@@ -1,107 +1,109 @@
-package main
+package sessions
 
 import (
+	"context"
 	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
 	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
-	"log"
-
-	"xorm.io/xorm"
+	"learning-web-chatboard3/repository"
 )
 
-var dbEngine *xorm.Engine
+var sessionRepo repository.SessionRepo
+var healthCheck func(ctx context.Context) error
 var config *common.Configuration
-var logger *log.Logger
+var logger *logging.Logger
 var server *rabbitrpc.RabbitClient
+var registry *rabbitrpc.HandlerRegistry
 
-func main() {
-	var err error
-
-	// config
-	config, err = common.LoadConfig()
+// Main runs the sessions service as a process on RabbitMQ
+func Main() {
+	cfg, err := common.LoadConfig()
 	if err != nil {
-		log.Fatalln(err.Error())
+		logging.Default().Fatal("cannot load config", "error", err)
 	}
 
 	//log
-	logger, err = common.OpenLogger(
-		config.LogToFile,
-		config.LogFileNameUsers,
-	)
+	lg, err := common.OpenLogger(cfg, cfg.LogFileNameSessions)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Default().Fatal("cannot open log", "error", err)
 	}
+	rabbitrpc.SetLogger(lg)
 
 	//database
-	dbEngine, err = common.OpenDb(
-		config.DbName,
-		config.ShowSQL,
-		0,
-	)
+	repos, err := repository.Open(cfg)
 	if err != nil {
-		common.LogError(logger).Fatalln(err.Error())
+		lg.Fatal("cannot open database", "error", err)
 	}
+	defer repos.Close()
+
+	//metrics
+	common.ServeMetrics(cfg.MetricsAddressSessions, lg)
 
 	//rabbit
-	server = rabbitrpc.NewRPCServer(
-		rabbitrpc.DefaultRabbitURL,
+	Start(cfg, lg, repos, cfg.RabbitTransport())
+
+	signals, stop := common.NotifyShutdown()
+	defer stop()
+	select {
+	case <-signals.Done():
+		logger.Info("shutting down")
+	case <-server.Publisher.CTX.Done():
+		break
+	case <-server.Subscriber.CTX.Done():
+		break
+	}
+	Shutdown()
+}
+
+// Start answers requests to the sessions service coming over transport.
+// shared by Main and all-in-one, so that both run the same handlers.
+func Start(
+	cfg *common.Configuration,
+	lg *logging.Logger,
+	repos *repository.Repositories,
+	transport rabbitrpc.Transport,
+) {
+	config = cfg
+	logger = lg.With("service", "sessions")
+	sessionRepo = repos.Sessions
+	healthCheck = repos.Ping
+
+	registry = routingRequest()
+	server = rabbitrpc.NewRPCServerWithTransport(
+		transport,
 		config.SessionsResQName,
 		config.SessionsReqQName,
 		config.SessionsExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.SessionsClientKey,
 		config.SessionsServerKey,
+		config.RabbitOptions(),
 		onRequestReceived,
 	)
-	defer server.Publisher.Done()
-	defer server.Subscriber.Done()
+}
 
-	select {
-	case <-server.Publisher.CTX.Done():
-		break
-	case <-server.Subscriber.CTX.Done():
-		break
+// Shutdown lets in-flight handlers finish and ack
+func Shutdown() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Warning("shutdown incomplete", "error", err)
 	}
 }
 
 func onRequestReceived(raws rabbitrpc.Raws) {
-	go func() {
-		var err *rabbitrpc.RabbitRPCError
-		envelop, err := rabbitrpc.FromBin(raws.Body)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-			return
-		}
-
-		err = routingRequest(envelop, raws.CorrelationId)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-		}
-	}()
+	go common.ServeRequest(server, registry, logger, raws)
 }
 
-func routingRequest(envelop *rabbitrpc.Envelope, corrId string,
-) (err *rabbitrpc.RabbitRPCError) {
-	switch envelop.DataTypeName {
-	case "Session":
-		var sess common.Session
-		err = envelop.Extract(&sess)
-		if err != nil {
-			return
-		}
-
-		switch envelop.FunctionToCall {
-		case "createSession":
-			createSession(corrId)
-		case "readSession":
-			readSession(&sess, corrId)
-		case "updateSession":
-			updateSession(&sess, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
+func routingRequest() (registry *rabbitrpc.HandlerRegistry) {
+	registry = rabbitrpc.NewHandlerRegistry()
+	registry.SetHealthCheck(healthCheck)
 
-	default:
-		err = rabbitrpc.ErrorTypeNotFound
-	}
+	rabbitrpc.Register(registry, "createSession", createSession)
+	rabbitrpc.Register(registry, "readSession", readSession)
 	return
 }
@@ -1,108 +1,50 @@
-package main
+package sessions
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"learning-web-chatboard3/common"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"learning-web-chatboard3/repository"
 	"time"
 )
 
-const sessionsTable = "sessions"
+var errNoSuchSession = rabbitrpc.NewError(
+	rabbitrpc.ErrorCodeNotFound,
+	"no such session",
+)
 
-func createSession(corrId string) {
+func createSession(ctx context.Context, _ *common.Session) (*common.Session, error) {
 	var sess common.Session
-	err := createSessionInternal(&sess)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, &sess, "Session", corrId)
+	err := createSessionInternal(ctx, &sess)
+	return &sess, err
 }
 
-func createSessionInternal(sess *common.Session) (err error) {
+func createSessionInternal(ctx context.Context, sess *common.Session) (err error) {
 	now := time.Now()
 	sess.UuId = common.NewUuIdString()
 	sess.CreatedAt = now
 
-	err = createSessionSQL(sess)
+	err = sessionRepo.Create(ctx, sess)
 	return
 }
 
-func readSession(sess *common.Session, corrId string) {
-	err := readSessionInternal(sess)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, sess, "Session", corrId)
+func readSession(ctx context.Context, sess *common.Session) (*common.Session, error) {
+	err := readSessionInternal(ctx, sess)
+	return sess, err
 }
 
-func readSessionInternal(sess *common.Session) (err error) {
+func readSessionInternal(ctx context.Context, sess *common.Session) (err error) {
 	if common.IsEmpty(sess.UuId) {
-		err = errors.New("need uuid for finding session")
-		return
-	}
-	err = readSessionSQL(sess)
-	return
-}
-
-func updateSession(sess *common.Session, corrId string) {
-	err := updateSessionInternal(sess)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, sess, "Session", corrId)
-}
-
-func updateSessionInternal(sess *common.Session) (err error) {
-	if common.IsEmpty(
-		sess.UuId,
-	) {
-		err = fmt.Errorf("contains empty string %s %s", sess.UuId, sess.State)
-		return
-	}
-	err = updateSessionSQL(sess)
-	return
-}
-
-func createSessionSQL(sess *common.Session) (err error) {
-	affected, err := dbEngine.
-		Table(sessionsTable).
-		InsertOne(sess)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need uuid for finding session",
 		)
+		return
 	}
-	return
-}
-
-func readSessionSQL(sess *common.Session) (err error) {
-	var ok bool
-	ok, err = dbEngine.
-		Table(sessionsTable).
-		Get(sess)
-	if err == nil && !ok {
-		err = errors.New("no such session")
-	}
-	return
-}
-
-func updateSessionSQL(sess *common.Session) (err error) {
-	affected, err := dbEngine.
-		Table(sessionsTable).
-		ID(sess.Id).
-		Update(sess)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
-		)
+	err = sessionRepo.Get(ctx, sess)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = errNoSuchSession
 	}
 	return
 }
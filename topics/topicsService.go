@@ -1,212 +1,135 @@
-package main
+package topics
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"learning-web-chatboard3/common"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"learning-web-chatboard3/repository"
 	"time"
 )
 
-const (
-	topicsTable      = "topics"
-	repliesTable     = "replies"
-	descendingUpdate = "last_update"
+var errNoSuchTopic = rabbitrpc.NewError(
+	rabbitrpc.ErrorCodeNotFound,
+	"no such thread",
 )
 
-func createTopic(topic *common.Topic, corrId string) {
-	err := createTopicInternal(topic)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, topic, "Topic", corrId)
+func createTopic(ctx context.Context, topic *common.Topic) (*common.Topic, error) {
+	err := createTopicInternal(ctx, topic)
+	return topic, err
 }
 
-func createTopicInternal(topic *common.Topic) (err error) {
+func createTopicInternal(ctx context.Context, topic *common.Topic) (err error) {
 	if common.IsEmpty(topic.Topic, topic.Owner) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"contains empty string",
+		)
 		return
 	}
 	now := time.Now()
 	topic.UuId = common.NewUuIdString()
 	topic.LastUpdate = now
 	topic.CreatedAt = now
-	err = createTopicSQL(topic)
+	err = topicRepo.Create(ctx, topic)
 	return
 }
 
-func createTopicSQL(topic *common.Topic) (err error) {
-	affected, err := dbEngine.
-		Table(topicsTable).
-		InsertOne(&topic)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
-		)
-	}
-	return
+func createReply(ctx context.Context, reply *common.Reply) (*common.Reply, error) {
+	err := createReplyInternal(ctx, reply)
+	return reply, err
 }
 
-func createReply(reply *common.Reply, corrId string) {
-	err := createReplyInternal(reply)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, reply, "Reply", corrId)
-}
-
-func createReplyInternal(reply *common.Reply) (err error) {
+func createReplyInternal(ctx context.Context, reply *common.Reply) (err error) {
 	if common.IsEmpty(
 		reply.Body,
 		reply.Contributor,
 	) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"contains empty string",
+		)
 		return
 	}
 	reply.UuId = common.NewUuIdString()
 	reply.CreatedAt = time.Now()
-	err = createReplySQL(reply)
+	err = replyRepo.Create(ctx, reply)
 	return
 }
 
-func createReplySQL(reply *common.Reply) (err error) {
-	affected, err := dbEngine.
-		Table(repliesTable).
-		InsertOne(reply)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
-		)
-	}
-	return
+func readATopic(ctx context.Context, topic *common.Topic) (*common.Topic, error) {
+	err := readATopicInternal(ctx, topic)
+	return topic, err
 }
 
-func readATopic(topic *common.Topic, corrId string) {
-	err := readATopicInternal(topic)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, topic, "Topic", corrId)
-}
-
-func readATopicInternal(topic *common.Topic) (err error) {
+func readATopicInternal(ctx context.Context, topic *common.Topic) (err error) {
 	if common.IsEmpty(topic.UuId) {
-		err = errors.New("need uuid for finding thread")
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need uuid for finding thread",
+		)
 		return
 	}
-	err = readATopicSQL(topic)
-	return
-}
-
-func readATopicSQL(topic *common.Topic) (err error) {
-	ok, err := dbEngine.
-		Table(topicsTable).
-		Get(topic)
-	if err == nil && !ok {
-		err = errors.New("no such thread")
+	err = topicRepo.Get(ctx, topic)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = errNoSuchTopic
 	}
 	return
 }
 
-func updateTopic(topic *common.Topic, corrId string) {
-	err := updateTopicInternal(topic)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, topic, "Topic", corrId)
+func updateTopic(ctx context.Context, topic *common.Topic) (*common.Topic, error) {
+	err := updateTopicInternal(ctx, topic)
+	return topic, err
 }
 
-func updateTopicInternal(topic *common.Topic) (err error) {
+func updateTopicInternal(ctx context.Context, topic *common.Topic) (err error) {
 	if common.IsEmpty(
 		topic.UuId,
 		topic.Topic,
 		topic.Owner,
 	) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"contains empty string",
+		)
 		return
 	}
 	topic.LastUpdate = time.Now()
-	err = updateTopicSQL(topic)
-	return
-}
-
-func updateTopicSQL(topic *common.Topic) (err error) {
-	affected, err := dbEngine.
-		Table(topicsTable).
-		ID(topic.Id).
-		Update(topic)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
-		)
+	err = topicRepo.UpdateByUuId(ctx, topic)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = errNoSuchTopic
 	}
 	return
 }
 
-func incrementTopic(topic *common.Topic, corrId string) {
-	err := incrementTopicInternal(topic)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, topic, "Topic", corrId)
+func incrementTopic(ctx context.Context, topic *common.Topic) (*common.Topic, error) {
+	err := incrementTopicInternal(ctx, topic)
+	return topic, err
 }
 
-func incrementTopicInternal(topic *common.Topic) (err error) {
-	err = readATopicInternal(topic)
-	if err != nil {
+func incrementTopicInternal(ctx context.Context, topic *common.Topic) (err error) {
+	if common.IsEmpty(topic.UuId) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need uuid for finding thread",
+		)
 		return
 	}
-
-	topic.NumReplies++
-	err = updateTopicInternal(topic)
-	return
-}
-
-func readRepliesInTopic(topic *common.Topic, corrId string) {
-	// is there a way to check valid id before?
-	replies, err := readRepliesInTopicSQL(topic)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+	topic.LastUpdate = time.Now()
+	err = topicRepo.IncrementReplies(ctx, topic)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = errNoSuchTopic
 	}
-
-	common.SendOK(server, &replies, "ReplySlice", corrId)
-}
-
-func readRepliesInTopicSQL(topic *common.Topic) (posts []common.Reply, err error) {
-	err = dbEngine.
-		Table(repliesTable).
-		Where("topic_id = ?", topic.Id).
-		Find(&posts)
 	return
 }
 
-func readTopics(corrId string) {
-	topics, err := readTopicsSQL()
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	} else {
-		common.SendOK(server, &topics, "TopicSlice", corrId)
-	}
+func readRepliesInTopic(ctx context.Context, topic *common.Topic) (*[]common.Reply, error) {
+	// is there a way to check valid id before?
+	replies, err := replyRepo.ListInTopic(ctx, topic.Id)
+	return &replies, err
 }
 
-func readTopicsSQL() (topics []common.Topic, err error) {
-	err = dbEngine.
-		Table(topicsTable).
-		Desc(descendingUpdate).
-		Find(&topics)
-	return
+func readTopics(ctx context.Context, _ *common.Topic) (*[]common.Topic, error) {
+	topics, err := topicRepo.List(ctx)
+	return &topics, err
 }
@@ -0,0 +1,59 @@
+package topics
+
+import (
+	"context"
+	"errors"
+	"learning-web-chatboard3/common"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"learning-web-chatboard3/repository"
+	"testing"
+)
+
+func useMemory(t *testing.T) {
+	t.Helper()
+	repos := repository.NewMemory()
+	topicRepo = repos.Topics
+	replyRepo = repos.Replies
+}
+
+func TestUpdateTopicByUuId(t *testing.T) {
+	useMemory(t)
+	ctx := context.Background()
+	first, err := createTopic(ctx, &common.Topic{Topic: "first", Owner: "owner", UserId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := createTopic(ctx, &common.Topic{Topic: "second", Owner: "owner", UserId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uuid only, or with a stale id of another topic
+	for _, id := range []uint{0, second.Id} {
+		updated, err := updateTopic(ctx, &common.Topic{
+			Id:    id,
+			UuId:  first.UuId,
+			Topic: "renamed",
+			Owner: "owner",
+		})
+		if err != nil {
+			t.Fatalf("id %d: %v", id, err)
+		}
+		if updated.Id != first.Id || updated.Topic != "renamed" {
+			t.Errorf("id %d: updated %+v", id, updated)
+		}
+	}
+	got, err := readATopic(ctx, &common.Topic{UuId: second.UuId})
+	if err != nil || got.Topic != "second" {
+		t.Errorf("other topic is %+v, %v", got, err)
+	}
+
+	_, err = updateTopic(ctx, &common.Topic{UuId: "unknown", Topic: "x", Owner: "owner"})
+	if !errors.Is(err, errNoSuchTopic) {
+		t.Errorf("unknown uuid: %v", err)
+	}
+	_, err = updateTopic(ctx, &common.Topic{Id: first.Id, Topic: "x", Owner: "owner"})
+	if rabbitrpc.CodeOf(err) != rabbitrpc.ErrorCodeValidation {
+		t.Errorf("without uuid: %v", err)
+	}
+}
@@ -1,129 +1,117 @@
-package main
+package users
 
 import (
+	"context"
 	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
 	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
-	"log"
-
-	"xorm.io/xorm"
+	"learning-web-chatboard3/repository"
 )
 
-var dbEngine *xorm.Engine
+var userRepo repository.UserRepo
+var loginRepo repository.LoginRepo
+var healthCheck func(ctx context.Context) error
 var config *common.Configuration
-var logger *log.Logger
+var logger *logging.Logger
 var server *rabbitrpc.RabbitClient
+var registry *rabbitrpc.HandlerRegistry
 
-func main() {
-	var err error
-
-	// config
-	config, err = common.LoadConfig()
+// Main runs the users service as a process on RabbitMQ
+func Main() {
+	cfg, err := common.LoadConfig()
 	if err != nil {
-		log.Fatalln(err.Error())
+		logging.Default().Fatal("cannot load config", "error", err)
 	}
 
 	//log
-	logger, err = common.OpenLogger(
-		config.LogToFile,
-		config.LogFileNameUsers,
-	)
+	lg, err := common.OpenLogger(cfg, cfg.LogFileNameUsers)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Default().Fatal("cannot open log", "error", err)
 	}
+	rabbitrpc.SetLogger(lg)
 
 	//database
-	dbEngine, err = common.OpenDb(
-		config.DbName,
-		config.ShowSQL,
-		0,
-	)
+	repos, err := repository.Open(cfg)
 	if err != nil {
-		common.LogError(logger).Fatalln(err.Error())
+		lg.Fatal("cannot open database", "error", err)
 	}
+	defer repos.Close()
+
+	//metrics
+	common.ServeMetrics(cfg.MetricsAddressUsers, lg)
 
 	//rabbit
-	server = rabbitrpc.NewRPCServer(
-		rabbitrpc.DefaultRabbitURL,
+	Start(cfg, lg, repos, cfg.RabbitTransport())
+
+	signals, stop := common.NotifyShutdown()
+	defer stop()
+	select {
+	case <-signals.Done():
+		logger.Info("shutting down")
+	case <-server.Publisher.CTX.Done():
+		break
+	case <-server.Subscriber.CTX.Done():
+		break
+	}
+	Shutdown()
+}
+
+// Start answers requests to the users service coming over transport.
+// shared by Main and all-in-one, so that both run the same handlers.
+func Start(
+	cfg *common.Configuration,
+	lg *logging.Logger,
+	repos *repository.Repositories,
+	transport rabbitrpc.Transport,
+) {
+	config = cfg
+	logger = lg.With("service", "users")
+	userRepo = repos.Users
+	loginRepo = repos.Logins
+	healthCheck = repos.Ping
+
+	registry = routingRequest()
+	server = rabbitrpc.NewRPCServerWithTransport(
+		transport,
 		config.UsersResQName,
 		config.UsersReqQName,
 		config.UsersExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.UsersClientKey,
 		config.UsersServerKey,
+		config.RabbitOptions(),
 		onRequestReceived,
 	)
-	defer server.Publisher.Done()
-	defer server.Subscriber.Done()
+}
 
-	select {
-	case <-server.Publisher.CTX.Done():
-		break
-	case <-server.Subscriber.CTX.Done():
-		break
+// Shutdown lets in-flight handlers finish and ack
+func Shutdown() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Warning("shutdown incomplete", "error", err)
 	}
 }
 
 func onRequestReceived(raws rabbitrpc.Raws) {
-	go func() {
-		var err *rabbitrpc.RabbitRPCError
-		envelop, err := rabbitrpc.FromBin(raws.Body)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-			return
-		}
-
-		err = routingRequest(envelop, raws.CorrelationId)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-		}
-	}()
+	go common.ServeRequest(server, registry, logger, raws)
 }
 
-func routingRequest(envelop *rabbitrpc.Envelope, corrId string,
-) (err *rabbitrpc.RabbitRPCError) {
-	// check data type
-	switch envelop.DataTypeName {
-
-	case "User":
-		var user common.User
-		err = envelop.Extract(&user)
-		if err != nil {
-			return
-		}
+func routingRequest() (registry *rabbitrpc.HandlerRegistry) {
+	registry = rabbitrpc.NewHandlerRegistry()
+	registry.SetHealthCheck(healthCheck)
 
-		// check function name
-		switch envelop.FunctionToCall {
-		case "createUser":
-			createUser(&user, corrId)
-		case "createLogin":
-			createLogin(&user, corrId)
-		case "readUser":
-			readUser(&user, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
+	rabbitrpc.Register(registry, "createUser", createUser)
+	rabbitrpc.Register(registry, "createLogin", createLogin)
+	rabbitrpc.Register(registry, "readUser", readUser)
+	rabbitrpc.Register(registry, "updatePassword", updatePassword)
 
-	case "Login":
-		var login common.Login
-		err = envelop.Extract(&login)
-		if err != nil {
-			return
-		}
-
-		// check function name
-		switch envelop.FunctionToCall {
-		case "readLogin":
-			readLogin(&login, corrId)
-		case "updateLogin":
-			updateLogin(&login, corrId)
-		case "deleteLogin":
-			deleteLogin(&login, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
-
-	default:
-		err = rabbitrpc.ErrorTypeNotFound
-	}
+	rabbitrpc.Register(registry, "readLogin", readLogin)
+	rabbitrpc.Register(registry, "updateLogin", updateLogin)
+	rabbitrpc.Register(registry, "deleteLogin", deleteLogin)
 	return
 }
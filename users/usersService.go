@@ -1,214 +1,202 @@
-package main
+package users
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"learning-web-chatboard3/common"
+	"learning-web-chatboard3/logging"
+	rabbitrpc "learning-web-chatboard3/rabbit-rpc"
+	"learning-web-chatboard3/repository"
 	"time"
 )
 
-const (
-	usersTable  = "users"
-	loginsTable = "logins"
-)
-
-func createUser(user *common.User, corrId string) {
-	err := createUserInternal(user)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, user, "User", corrId)
+func createUser(ctx context.Context, user *common.User) (*common.User, error) {
+	err := createUserInternal(ctx, user)
+	return user, err
 }
 
-func createUserInternal(user *common.User) (err error) {
+func createUserInternal(ctx context.Context, user *common.User) (err error) {
 	if common.IsEmpty(
 		user.Name,
 		user.Email,
 		user.Password,
 	) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"contains empty string",
+		)
 		return
 	}
 	user.UuId = common.NewUuIdString()
 	user.CreatedAt = time.Now()
-	err = createUserSQL(user)
-	return
-}
-
-func createUserSQL(user *common.User) (err error) {
-	affected, err := dbEngine.
-		Table(usersTable).
-		InsertOne(user)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
+	err = userRepo.Create(ctx, user)
+	if errors.Is(err, repository.ErrConflict) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeConflict,
+			"name or email is already used",
 		)
 	}
 	return
 }
 
-func createLogin(user *common.User, corrId string) {
-	login, err := createLoginInternal(user)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, login, "Login", corrId)
+func createLogin(ctx context.Context, login *common.Login) (*common.Login, error) {
+	err := createLoginInternal(ctx, login)
+	return login, err
 }
 
-func createLoginInternal(user *common.User) (login *common.Login, err error) {
-	if common.IsEmpty(user.Name, user.Email) {
-		err = errors.New("contains empty string")
+// createLoginInternal starts login of kind of the user of UserId and UserName
+func createLoginInternal(ctx context.Context, login *common.Login) (err error) {
+	if login.UserId == 0 || common.IsEmpty(login.UserName) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need user id and name for creating login",
+		)
+		return
+	}
+	if login.Kind != common.LoginKindBrowser && login.Kind != common.LoginKindAPI {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			fmt.Sprintf("unknown kind of login %q", login.Kind),
+		)
 		return
 	}
 	now := time.Now()
-	login = &common.Login{
+	*login = common.Login{
 		UuId:       common.NewUuIdString(),
-		UserName:   user.Name,
-		UserId:     user.Id,
+		UserName:   login.UserName,
+		UserId:     login.UserId,
+		Kind:       login.Kind,
 		LastUpdate: now,
 		CreatedAt:  now,
 	}
-	err = createLoginSQL(login)
+	err = loginRepo.Create(ctx, login)
 	return
 }
 
-func createLoginSQL(login *common.Login) (err error) {
-	affected, err := dbEngine.
-		Table(loginsTable).
-		InsertOne(login)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something's wrong. returned value was %d",
-			affected,
-		)
-	}
-	return
+func readUser(ctx context.Context, user *common.User) (*common.User, error) {
+	err := readUserInternal(ctx, user)
+	return user, err
 }
 
-func readUser(user *common.User, corrId string) {
-	err := readUserInternal(user)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
+func readUserInternal(ctx context.Context, user *common.User) (err error) {
+	if user.Id == 0 && common.IsEmpty(user.Email) && common.IsEmpty(user.UuId) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need id, email or uuid for finding user",
+		)
 		return
 	}
-
-	common.SendOK(server, user, "User", corrId)
-}
-
-func readUserInternal(user *common.User) (err error) {
-	if common.IsEmpty(user.Email) && common.IsEmpty(user.UuId) {
-		err = errors.New("need email or uuid for finding user")
-		return
+	err = userRepo.Get(ctx, user)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeNotFound,
+			"no such user",
+		)
 	}
-	err = readUserSQL(user)
 	return
 }
 
-func readUserSQL(user *common.User) (err error) {
-	var ok bool
-	ok, err = dbEngine.
-		Table(usersTable).
-		Get(user)
-	if err == nil && !ok {
-		err = errors.New("no such user")
-	}
-	return
+func updatePassword(ctx context.Context, user *common.User) (*common.User, error) {
+	err := updatePasswordInternal(ctx, user)
+	return user, err
 }
 
-func readLogin(login *common.Login, corrId string) {
-	err := readLoginInternal(login)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
+// updatePasswordInternal saves only the password of user of its id
+func updatePasswordInternal(ctx context.Context, user *common.User) (err error) {
+	if user.Id == 0 || common.IsEmpty(user.Password) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need id and password for updating password",
+		)
 		return
 	}
+	err = userRepo.Update(ctx, &common.User{
+		Id:       user.Id,
+		Password: user.Password,
+	})
+	if errors.Is(err, repository.ErrNotFound) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeNotFound,
+			"no such user",
+		)
+	}
+	return
+}
 
-	common.SendOK(server, login, "Login", corrId)
+func readLogin(ctx context.Context, login *common.Login) (*common.Login, error) {
+	err := readLoginInternal(ctx, login)
+	return login, err
 }
 
-func readLoginInternal(login *common.Login) (err error) {
+func readLoginInternal(ctx context.Context, login *common.Login) (err error) {
 	if common.IsEmpty(login.UuId) {
-		err = errors.New("need uuid for finding login")
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			"need uuid for finding login",
+		)
 		return
 	}
-	err = readLoginSQL(login)
-	return
-}
-
-func readLoginSQL(login *common.Login) (err error) {
-	var ok bool
-	ok, err = dbEngine.
-		Table(loginsTable).
-		Get(login)
-	if err == nil && !ok {
-		err = errors.New("no such login")
+	err = loginRepo.Get(ctx, login)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeNotFound,
+			"no such login",
+		)
 	}
 	return
 }
 
-func updateLogin(login *common.Login, corrId string) {
-	err := updateLoginInternal(login)
-	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
-	}
-
-	common.SendOK(server, login, "Login", corrId)
+func updateLogin(ctx context.Context, login *common.Login) (*common.Login, error) {
+	err := updateLoginInternal(ctx, login)
+	return login, err
 }
 
-func updateLoginInternal(login *common.Login) (err error) {
+func updateLoginInternal(ctx context.Context, login *common.Login) (err error) {
 	if common.IsEmpty(
 		login.UuId,
 		login.UserName,
 	) {
-		err = fmt.Errorf("contains empty string %s %s", login.UuId, login.UserName)
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeValidation,
+			fmt.Sprintf("contains empty string %s %s", login.UuId, login.UserName),
+		)
 		return
 	}
 	login.LastUpdate = time.Now()
-	err = updateLoginSQL(login)
-	return
-}
-
-func updateLoginSQL(login *common.Login) (err error) {
-	affected, err := dbEngine.
-		Table(loginsTable).
-		ID(login.Id).
-		Update(login)
-	if err == nil && affected != 1 {
-		err = fmt.Errorf(
-			"something wrong. returned value was %d",
-			affected,
+	err = loginRepo.Update(ctx, login)
+	if errors.Is(err, repository.ErrNotFound) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.ErrorCodeNotFound,
+			"no such login",
 		)
 	}
 	return
 }
 
-func deleteLogin(login *common.Login, corrId string) {
-	err := deleteLoginInternal(login)
+func deleteLogin(ctx context.Context, login *common.Login) (msg *common.SimpleMessage, err error) {
+	err = deleteLoginInternal(ctx, login)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
+		return
 	}
 
-	msg := &common.SimpleMessage{
+	msg = &common.SimpleMessage{
 		Message: "deleted",
 	}
-	common.SendOK(server, msg, "SimpleMessage", corrId)
-}
-
-func deleteLoginInternal(login *common.Login) (err error) {
-	err = deleteLoginSQL(login)
 	return
 }
 
-func deleteLoginSQL(login *common.Login) (err error) {
-	affected, err := dbEngine.
-		Table(loginsTable).
-		Delete(login)
+func deleteLoginInternal(ctx context.Context, login *common.Login) (err error) {
+	deleted, err := loginRepo.Delete(ctx, login)
+	if err != nil {
+		return
+	}
 
-	common.LogInfo(logger).Printf("deleted %d linked %v", affected, *login)
+	logging.FromContext(ctx, logger).Info(
+		"deleted logins",
+		"count", deleted,
+		"login_uuid", login.UuId,
+		"user_id", login.UserId,
+	)
 	return
 }